@@ -0,0 +1,66 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// WriteBatch 批量写入 整个batch在wal中只占一条记录
+// 恢复时要么全部生效 要么全部丢弃
+type WriteBatch struct {
+	records []*Record
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.records = append(b.records, &Record{Key: key, Value: value, RType: RecordUpdate})
+}
+func (b *WriteBatch) Delete(key string) {
+	b.records = append(b.records, &Record{Key: key, RType: RecordDelete})
+}
+
+// Clear 清空batch 可以重复使用
+func (b *WriteBatch) Clear() {
+	b.records = b.records[:0]
+}
+func (b *WriteBatch) Count() int {
+	return len(b.records)
+}
+
+// Bytes 编码格式 [count][len][record][len][record]...
+func (b *WriteBatch) Bytes() (int, []byte) {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, uint32(len(b.records)))
+	for _, r := range b.records {
+		n, body := r.Bytes()
+		binary.Write(buf, binary.LittleEndian, uint32(n))
+		buf.Write(body)
+	}
+	return buf.Len(), buf.Bytes()
+}
+
+// Restore 解码batch 数据不完整时返回错误
+func (b *WriteBatch) Restore(data []byte) error {
+	var count, n uint32
+	buf := bytes.NewBuffer(data)
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return fmt.Errorf("failed to read batch count: %w", err)
+	}
+	b.records = make([]*Record, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
+			return fmt.Errorf("failed to read batch record size: %w", err)
+		}
+		if buf.Len() < int(n) {
+			return fmt.Errorf("batch record %d truncated", i)
+		}
+		record := &Record{}
+		record.Restore(buf.Next(int(n)))
+		b.records = append(b.records, record)
+	}
+	return nil
+}
@@ -1,60 +1,174 @@
 package lsm
 
-// todo: 实现布隆过滤器
 import (
-	"hash"
+	"encoding/binary"
+	"fmt"
 	"math"
 
 	"github.com/spaolacci/murmur3"
 )
 
 // BloomFilter represents a Bloom filter data structure
+// bit按位压缩存储 所有探测位置由一次murmur3哈希通过double hashing得到
 type BloomFilter struct {
-	bitSet    []bool
-	size      uint
-	hashFuncs []hash.Hash64
+	bits         []byte
+	size         uint32 // bit数量
+	numHashFuncs uint32
 }
 
 // NewBloomFilter creates a new Bloom filter with the given size and number of hash functions
 func NewBloomFilter(size uint, numHashFuncs uint) *BloomFilter {
-	hashFuncs := make([]hash.Hash64, numHashFuncs)
-	for i := uint(0); i < numHashFuncs; i++ {
-		hashFuncs[i] = murmur3.New64WithSeed(uint32(i))
-	}
+	size = max(size, 64)
 	return &BloomFilter{
-		bitSet:    make([]bool, size),
-		size:      size,
-		hashFuncs: hashFuncs,
+		bits:         make([]byte, (size+7)/8),
+		size:         uint32(size),
+		numHashFuncs: uint32(numHashFuncs),
 	}
 }
 
+// NewBloomFilterForKeys sizes the filter for numKeys keys with bitsPerKey bits each
+func NewBloomFilterForKeys(numKeys int, bitsPerKey int) *BloomFilter {
+	return NewBloomFilter(uint(numKeys*bitsPerKey), bloomHashFuncs(bitsPerKey))
+}
+
+// k = ln2 * bits/key 时误判率最低
+func bloomHashFuncs(bitsPerKey int) uint {
+	return uint(min(max(float64(bitsPerKey)*math.Ln2, 1), 30))
+}
+
+// 将一次64位哈希拆分为两个32位哈希 第i次探测的位置为 h1 + i*h2
+func bloomHash(item []byte) (uint32, uint32) {
+	h := murmur3.Sum64(item)
+	return uint32(h), uint32(h>>32) | 1
+}
+
 // Add adds an item to the Bloom filter
 func (bf *BloomFilter) Add(item []byte) {
-	for _, h := range bf.hashFuncs {
-		h.Reset()
-		h.Write(item)
-		index := uint(h.Sum64() % uint64(bf.size))
-		bf.bitSet[index] = true
+	h1, h2 := bloomHash(item)
+	for i := uint32(0); i < bf.numHashFuncs; i++ {
+		pos := (h1 + i*h2) % bf.size
+		bf.bits[pos/8] |= 1 << (pos % 8)
 	}
 }
 
 // Contains checks if an item might be in the Bloom filter
 func (bf *BloomFilter) Contains(item []byte) bool {
-	for _, h := range bf.hashFuncs {
-		h.Reset()
-		h.Write(item)
-		index := uint(h.Sum64() % uint64(bf.size))
-		if !bf.bitSet[index] {
+	h1, h2 := bloomHash(item)
+	for i := uint32(0); i < bf.numHashFuncs; i++ {
+		pos := (h1 + i*h2) % bf.size
+		if bf.bits[pos/8]&(1<<(pos%8)) == 0 {
 			return false
 		}
 	}
 	return true
 }
 
+// MayContain 实现Filter接口
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	return bf.Contains(key)
+}
+
 // EstimateFalsePositiveRate calculates the estimated false positive rate
 func (bf *BloomFilter) EstimateFalsePositiveRate(numItems int) float64 {
-	k := float64(len(bf.hashFuncs))
+	k := float64(bf.numHashFuncs)
 	m := float64(bf.size)
 	n := float64(numItems)
 	return math.Pow(1-math.Exp(-k*n/m), k)
 }
+
+// Marshal encodes the filter as [size u32][numHashFuncs u32][bits]
+func (bf *BloomFilter) Marshal() []byte {
+	data := make([]byte, 8+len(bf.bits))
+	binary.LittleEndian.PutUint32(data, bf.size)
+	binary.LittleEndian.PutUint32(data[4:], bf.numHashFuncs)
+	copy(data[8:], bf.bits)
+	return data
+}
+
+// Unmarshal decodes a filter written by Marshal
+func (bf *BloomFilter) Unmarshal(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("bloom filter too short: %d", len(data))
+	}
+	size := binary.LittleEndian.Uint32(data)
+	numHashFuncs := binary.LittleEndian.Uint32(data[4:])
+	if size == 0 || uint32(len(data)-8) != (size+7)/8 {
+		return fmt.Errorf("bloom filter length mismatch: %d bits, %d bytes", size, len(data)-8)
+	}
+	bf.size, bf.numHashFuncs = size, numHashFuncs
+	bf.bits = append([]byte(nil), data[8:]...)
+	return nil
+}
+
+// blockedBloomBits 每个block为一个cache line 一个key的所有探测都落在同一个block中
+const blockedBloomBits = 512
+
+// BlockedBloomFilter cache友好的bloom filter 每次查询只访问一个cache line
+// 相同空间下误判率比标准bloom filter略高
+type BlockedBloomFilter struct {
+	bits         []byte
+	numBlocks    uint32
+	numHashFuncs uint32
+}
+
+// NewBlockedBloomFilterForKeys sizes the filter for numKeys keys with bitsPerKey bits each
+func NewBlockedBloomFilterForKeys(numKeys int, bitsPerKey int) *BlockedBloomFilter {
+	numBlocks := uint32(max((numKeys*bitsPerKey+blockedBloomBits-1)/blockedBloomBits, 1))
+	return &BlockedBloomFilter{
+		bits:         make([]byte, numBlocks*blockedBloomBits/8),
+		numBlocks:    numBlocks,
+		numHashFuncs: uint32(bloomHashFuncs(bitsPerKey)),
+	}
+}
+
+// 128位哈希的高64位选择block 低64位拆分之后在block内部double hashing
+func (bf *BlockedBloomFilter) probe(item []byte, fn func(pos uint32) bool) bool {
+	lo, hi := murmur3.Sum128(item)
+	base := uint32(hi%uint64(bf.numBlocks)) * blockedBloomBits
+	h1, h2 := uint32(lo), uint32(lo>>32)|1
+	for i := uint32(0); i < bf.numHashFuncs; i++ {
+		if !fn(base + (h1+i*h2)%blockedBloomBits) {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds an item to the filter
+func (bf *BlockedBloomFilter) Add(item []byte) {
+	bf.probe(item, func(pos uint32) bool {
+		bf.bits[pos/8] |= 1 << (pos % 8)
+		return true
+	})
+}
+
+// MayContain checks if an item might be in the filter
+func (bf *BlockedBloomFilter) MayContain(item []byte) bool {
+	return bf.probe(item, func(pos uint32) bool {
+		return bf.bits[pos/8]&(1<<(pos%8)) != 0
+	})
+}
+
+// Marshal encodes the filter as [numBlocks u32][numHashFuncs u32][bits]
+func (bf *BlockedBloomFilter) Marshal() []byte {
+	data := make([]byte, 8+len(bf.bits))
+	binary.LittleEndian.PutUint32(data, bf.numBlocks)
+	binary.LittleEndian.PutUint32(data[4:], bf.numHashFuncs)
+	copy(data[8:], bf.bits)
+	return data
+}
+
+// Unmarshal decodes a filter written by Marshal
+func (bf *BlockedBloomFilter) Unmarshal(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("blocked bloom filter too short: %d", len(data))
+	}
+	numBlocks := binary.LittleEndian.Uint32(data)
+	numHashFuncs := binary.LittleEndian.Uint32(data[4:])
+	if numBlocks == 0 || uint32(len(data)-8) != numBlocks*blockedBloomBits/8 {
+		return fmt.Errorf("blocked bloom filter length mismatch: %d blocks, %d bytes", numBlocks, len(data)-8)
+	}
+	bf.numBlocks, bf.numHashFuncs = numBlocks, numHashFuncs
+	bf.bits = append([]byte(nil), data[8:]...)
+	return nil
+}
@@ -0,0 +1,122 @@
+package lsm
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestBloomFilter_Marshal(t *testing.T) {
+	bf := NewBloomFilterForKeys(100, 10)
+	for i := range 100 {
+		bf.Add([]byte(util.GenerateKeyString(i)))
+	}
+	restored := new(BloomFilter)
+	assert.Nil(t, restored.Unmarshal(bf.Marshal()))
+	assert.Equal(t, bf, restored)
+
+	misses := 0
+	for i := 100; i < 1100; i++ {
+		if !restored.Contains([]byte(util.GenerateKeyString(i))) {
+			misses++
+		}
+	}
+	// 10 bits/key 误判率约为1%
+	assert.Greater(t, misses, 950)
+
+	assert.NotNil(t, new(BloomFilter).Unmarshal(bf.Marshal()[:10]))
+}
+
+func TestFilterPolicy(t *testing.T) {
+	var keys [][]byte
+	for i := range 1000 {
+		keys = append(keys, []byte(util.GenerateKeyString(i)))
+	}
+	for _, policy := range []FilterPolicy{
+		NewBloomFilterPolicy(10),
+		NewBlockedBloomFilterPolicy(10),
+		NewRibbonFilterPolicy(10),
+	} {
+		data, err := policy.CreateFilter(keys)
+		assert.Nil(t, err)
+		filter, err := policy.NewFilter(data)
+		assert.Nil(t, err)
+		for _, key := range keys {
+			assert.True(t, filter.MayContain(key), policy.Name())
+		}
+		falsePositives := 0
+		for i := 1000; i < 11000; i++ {
+			if filter.MayContain([]byte(util.GenerateKeyString(i))) {
+				falsePositives++
+			}
+		}
+		assert.Less(t, falsePositives, 300, policy.Name())
+
+		// 名称不一致的过滤器被忽略
+		block := encodeFilterBlock(policy.Name(), data)
+		f, err := decodeFilterBlock(policy, block)
+		assert.Nil(t, err)
+		assert.NotNil(t, f)
+		f, err = decodeFilterBlock(NewBloomFilterPolicy(5), encodeFilterBlock("other", data))
+		assert.Nil(t, err)
+		assert.Nil(t, f)
+	}
+}
+
+func TestNode_Filter(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir)
+	assert.Nil(t, err)
+	m := NewMemTable()
+	for i := 0; i < 100; i += 2 {
+		m.Set(&Record{Key: util.GenerateKeyString(i), Value: util.GenerateValueString(12), RType: RecordUpdate, Seq: uint64(i + 1)})
+	}
+	fileName := path.Join(dir, "1.sst")
+	w, err := NewSSTWriter(fileName, opts)
+	assert.Nil(t, err)
+	_, err = w.SyncMemTable(m)
+	assert.Nil(t, err)
+
+	r, err := NewSSTReader(fileName)
+	assert.Nil(t, err)
+	node, err := NewNode(fileName, r, opts, nil)
+	assert.Nil(t, err)
+	defer node.unref()
+	assert.NotNil(t, node.filter)
+	for i := 0; i < 100; i += 2 {
+		key := util.GenerateKeyString(i)
+		assert.True(t, node.filter.MayContain([]byte(key)))
+		record, err := node.Query(key, MaxSeq)
+		assert.Nil(t, err)
+		assert.Equal(t, key, record.Key)
+	}
+	record, err := node.Query(util.GenerateKeyString(51), MaxSeq)
+	assert.Nil(t, err)
+	assert.Nil(t, record)
+
+	// 读取时使用不同类型的过滤器
+	opts, err = NewOptions(dir, WithFilterPolicy(NewRibbonFilterPolicy(10)))
+	assert.Nil(t, err)
+	r, err = NewSSTReader(fileName)
+	assert.Nil(t, err)
+	other, err := NewNode(fileName, r, opts, nil)
+	assert.Nil(t, err)
+	defer other.unref()
+	assert.Nil(t, other.filter)
+
+	// 关闭过滤器
+	opts, err = NewOptions(dir, WithBloomBitsPerKey(-1))
+	assert.Nil(t, err)
+	w, err = NewSSTWriter(fileName+".nofilter", opts)
+	assert.Nil(t, err)
+	_, err = w.SyncMemTable(m)
+	assert.Nil(t, err)
+	r, err = NewSSTReader(fileName + ".nofilter")
+	assert.Nil(t, err)
+	plain, err := NewNode(fileName+".nofilter", r, opts, nil)
+	assert.Nil(t, err)
+	defer plain.unref()
+	assert.Nil(t, plain.filter)
+}
@@ -0,0 +1,171 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// 每个分片的最小容量 容量较小时分片过多会导致单个分片放不下block
+const (
+	minCacheShardBytes = 512 << 10
+	maxCacheShards     = 64
+)
+
+// cacheKey 文件编号在目录中唯一且不会重复使用 与偏移一起唯一确定一个block
+type cacheKey struct {
+	fileNumber uint64
+	offset     uint64
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	value  any
+	charge int
+	pinned bool          // 固定的数据不会被淘汰 只能通过EraseFile释放
+	elem   *list.Element // pinned时为nil
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int
+	usage    int
+	pinned   int
+	items    map[cacheKey]*cacheEntry
+	lru      *list.List // 未固定的数据 队首为最近使用
+}
+
+// BlockCache 所有节点共享的block缓存 按照容量淘汰最久没有使用的数据
+// 分片减少锁竞争 每个分片独立淘汰
+type BlockCache struct {
+	capacity int
+	shards   []*cacheShard
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+// CacheStats block cache的统计信息
+type CacheStats struct {
+	Capacity    int
+	Usage       int // 包含固定的数据
+	PinnedUsage int
+	Hits        uint64
+	Misses      uint64
+}
+
+// NewBlockCache 创建容量为capacity字节的缓存
+func NewBlockCache(capacity int) *BlockCache {
+	n := 1
+	for n < maxCacheShards && capacity/(n*2) >= minCacheShardBytes {
+		n *= 2
+	}
+	c := &BlockCache{capacity: capacity, shards: make([]*cacheShard, n)}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			capacity: capacity / n,
+			items:    make(map[cacheKey]*cacheEntry),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *BlockCache) shard(key cacheKey) *cacheShard {
+	h := key.fileNumber*0x9e3779b97f4a7c15 ^ key.offset
+	h ^= h >> 32
+	return c.shards[h&uint64(len(c.shards)-1)]
+}
+
+// Lookup 查找block 命中时移动到队首
+func (c *BlockCache) Lookup(fileNumber, offset uint64) (any, bool) {
+	key := cacheKey{fileNumber: fileNumber, offset: offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	e, ok := s.items[key]
+	if ok && e.elem != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return e.value, true
+}
+
+// Insert 写入block 超出容量时从最久没有使用的数据开始淘汰
+// 单个block超过分片容量时写入之后立即被淘汰
+func (c *BlockCache) Insert(fileNumber, offset uint64, value any, charge int) {
+	c.insert(cacheKey{fileNumber: fileNumber, offset: offset}, value, charge, false)
+}
+
+// Pin 写入并固定数据 用于索引和过滤器 计入容量但是不会被淘汰
+func (c *BlockCache) Pin(fileNumber, offset uint64, value any, charge int) {
+	c.insert(cacheKey{fileNumber: fileNumber, offset: offset}, value, charge, true)
+}
+
+func (c *BlockCache) insert(key cacheKey, value any, charge int, pinned bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.items[key]; ok {
+		pinned = pinned || old.pinned
+		s.remove(old)
+	}
+	e := &cacheEntry{key: key, value: value, charge: charge, pinned: pinned}
+	s.items[key] = e
+	s.usage += charge
+	if pinned {
+		s.pinned += charge
+	} else {
+		e.elem = s.lru.PushFront(e)
+	}
+	for s.usage > s.capacity && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// 需要持有s.mu
+func (s *cacheShard) remove(e *cacheEntry) {
+	delete(s.items, e.key)
+	s.usage -= e.charge
+	if e.pinned {
+		s.pinned -= e.charge
+	} else {
+		s.lru.Remove(e.elem)
+	}
+}
+
+// EraseFile 释放文件的所有数据 包括固定的数据 文件被删除或者关闭时调用
+func (c *BlockCache) EraseFile(fileNumber uint64) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, e := range s.items {
+			if key.fileNumber == fileNumber {
+				s.remove(e)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (c *BlockCache) Stats() CacheStats {
+	stats := CacheStats{Capacity: c.capacity, Hits: c.hits.Load(), Misses: c.misses.Load()}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Usage += s.usage
+		stats.PinnedUsage += s.pinned
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// 估算block解析之后占用的内存
+func blockCharge(mem *MemTable) int {
+	charge := 0
+	for _, record := range mem.GetRecords() {
+		charge += len(record.Key) + len(record.Value) + 48
+	}
+	return charge
+}
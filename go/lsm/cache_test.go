@@ -0,0 +1,111 @@
+package lsm
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestBlockCache_LRU(t *testing.T) {
+	c := NewBlockCache(100)
+	assert.Equal(t, 1, len(c.shards))
+	c.Insert(1, 0, "a", 40)
+	c.Insert(1, 10, "b", 40)
+	// 访问a之后b成为最久没有使用的数据
+	v, ok := c.Lookup(1, 0)
+	assert.True(t, ok)
+	assert.Equal(t, "a", v)
+	c.Insert(2, 0, "c", 40)
+	_, ok = c.Lookup(1, 10)
+	assert.False(t, ok)
+	_, ok = c.Lookup(2, 0)
+	assert.True(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, 80, stats.Usage)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	// 固定的数据不会被淘汰 只能通过EraseFile释放
+	c.Pin(3, 0, "index", 90)
+	_, ok = c.Lookup(3, 0)
+	assert.True(t, ok)
+	_, ok = c.Lookup(1, 0)
+	assert.False(t, ok)
+	assert.Equal(t, 90, c.Stats().PinnedUsage)
+	c.EraseFile(3)
+	_, ok = c.Lookup(3, 0)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Stats().Usage)
+
+	assert.Equal(t, maxCacheShards, len(NewBlockCache(1<<30).shards))
+}
+
+func TestLsm_BlockCache(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(100), WithPinIndexAndFilterBlocks(true))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 500 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	db.waitForCompact()
+	assert.True(t, db.BlockCacheStats().PinnedUsage > 0)
+	// 索引和过滤器只在block cache中
+	for _, nodes := range db.nodes {
+		for _, node := range nodes {
+			assert.Nil(t, node.spareIndex)
+			assert.Nil(t, node.filter)
+		}
+	}
+
+	// 并发查询共享block cache
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				_, err := db.Query(util.GenerateKeyString(i))
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	stats := db.BlockCacheStats()
+	assert.True(t, stats.Hits > 0)
+	assert.True(t, stats.Misses > 0)
+	assert.True(t, stats.Usage <= stats.Capacity)
+
+	// 关闭之后释放所有数据
+	assert.Nil(t, db.Close())
+	assert.Equal(t, 0, db.BlockCacheStats().Usage)
+}
+
+func TestLsm_CacheIndexAndFilterBlocks(t *testing.T) {
+	// 容量很小 索引和过滤器会被数据block淘汰 之后从文件重新读取
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(100), WithBlockCacheSize(1<<10), WithCacheIndexAndFilterBlocks(true))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 500 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	db.waitForCompact()
+	assert.Equal(t, 0, db.BlockCacheStats().PinnedUsage)
+	for range 2 {
+		for i := range 500 {
+			_, err := db.Query(util.GenerateKeyString(i))
+			assert.Nil(t, err)
+		}
+		entries, err := db.Scan("", "", 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 500, len(entries))
+	}
+	stats := db.BlockCacheStats()
+	assert.True(t, stats.Usage <= stats.Capacity)
+}
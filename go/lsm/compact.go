@@ -1,98 +1,324 @@
 package lsm
 
 import (
-	"os"
+	"sort"
 )
 
-// 获取需要合并的nodes
-func (t *Lsm) getMergeBlock(level int) ([]*Node, []string) {
-	var fileNames []string
-	for _, node := range t.nodes[level] {
-		fileNames = append(fileNames, node.fileName)
+// compaction 一次合并任务 将level层的inputs和level+1层与之重叠的overlaps合并
+// 输出按照目标大小切分为多个文件 替换level+1层中的overlaps
+type compaction struct {
+	level      int
+	inputs     []*Node
+	overlaps   []*Node
+	bottommost bool // 更深的层次没有与之重叠的文件 可以清理删除标记
+}
+
+// 后台合并协程 数量由maxBackgroundJobs决定
+// 不同的合并只要不涉及相同的层次就可以并发执行
+func (t *Lsm) compactWorker() {
+	defer t.bgWait.Done()
+	for {
+		select {
+		case <-t.closeChan:
+			return
+		case <-t.compactChan:
+		}
+		c := t.pickCompaction()
+		if c == nil {
+			continue
+		}
+		// 其余空闲的协程继续检查是否有可以并发执行的合并
+		t.notifyCompaction()
+		if err := t.getAllData(c); err != nil {
+			panic(err)
+		}
+		t.lock.Lock()
+		t.levelBusy[c.level], t.levelBusy[c.level+1] = false, false
+		t.runningCompactions--
+		t.lock.Unlock()
+		t.notifyCompaction()
 	}
-	return t.nodes[level], fileNames
 }
 
-// 查看这层是否进行合并操作
-func (t *Lsm) checkLevelOverflow(level int) bool {
-	if level == t.opts.maxLevel {
-		return false
+// 通知合并协程 已经有通知未处理时直接返回
+func (t *Lsm) notifyCompaction() {
+	select {
+	case t.compactChan <- struct{}{}:
+	default:
 	}
-	return len(t.nodes[level]) >= t.opts.maxLevelNum
 }
 
-// 需要进行层次合并
-func (t *Lsm) compactLevel(level int) error {
-	if !t.checkLevelOverflow(level) {
+// 选择分数最高的层次进行合并 正在合并的层次不参与
+func (t *Lsm) pickCompaction() *compaction {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	best, bestScore := -1, 1.0
+	for level := 0; level < len(t.nodes)-1; level++ {
+		if t.levelBusy[level] || t.levelBusy[level+1] {
+			continue
+		}
+		if score := t.levelScore(level); score >= bestScore {
+			best, bestScore = level, score
+		}
+	}
+	if best < 0 {
 		return nil
 	}
-	if err := t.getAllData(level); err != nil {
-		return err
+	t.levelBusy[best], t.levelBusy[best+1] = true, true
+	t.runningCompactions++
+	return t.newCompaction(best)
+}
+
+// 选择level层的inputs和level+1层的overlaps 需要持有t.lock
+func (t *Lsm) newCompaction(level int) *compaction {
+	c := &compaction{level: level, inputs: t.pickInputs(level)}
+	start, end := keyRange(c.inputs)
+	c.overlaps = overlappingNodes(t.nodes[level+1], start, end)
+	if level > 0 {
+		t.compactPointer[level] = end
 	}
-	if err := t.compactLevel(level + 1); err != nil {
-		return err
+	// 输出覆盖inputs和overlaps的范围 overlaps可能超出inputs的范围
+	lo, hi := keyRange(append(append([]*Node(nil), c.inputs...), c.overlaps...))
+	c.bottommost = true
+	for i := level + 2; i < len(t.nodes); i++ {
+		if len(overlappingNodes(t.nodes[i], lo, hi)) > 0 {
+			c.bottommost = false
+		}
 	}
-	return nil
+	return c
+}
+
+// 选择参与合并的文件 level0的文件相互重叠 全部参与合并
+// 其余层次从上次合并的位置之后选择一个文件 轮流覆盖整个key空间
+func (t *Lsm) pickInputs(level int) []*Node {
+	nodes := t.nodes[level]
+	if level == 0 {
+		return nodes
+	}
+	for _, node := range nodes {
+		if node.startKey > t.compactPointer[level] {
+			return []*Node{node}
+		}
+	}
+	return []*Node{nodes[0]}
+}
+
+// 获取节点覆盖的key范围
+func keyRange(nodes []*Node) (string, string) {
+	start, end := nodes[0].startKey, nodes[0].endKey
+	for _, node := range nodes[1:] {
+		start, end = min(start, node.startKey), max(end, node.endKey)
+	}
+	return start, end
+}
+
+// 获取与[start,end]重叠的节点
+func overlappingNodes(nodes []*Node, start, end string) []*Node {
+	var ans []*Node
+	for _, node := range nodes {
+		if node.endKey >= start && node.startKey <= end {
+			ans = append(ans, node)
+		}
+	}
+	return ans
+}
+
+// 按照key排序 用于level0之外的层次
+func sortNodes(nodes []*Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].startKey < nodes[j].startKey
+	})
+}
+
+// 计算每一层的分数 大于等于1时需要合并
+// level0的文件相互重叠 按照文件数量计算 其余层按照总大小和目标大小的比值
+func (t *Lsm) levelScore(level int) float64 {
+	if level >= len(t.nodes)-1 {
+		return 0
+	}
+	if level == 0 {
+		return float64(len(t.nodes[0])) / float64(t.opts.maxLevelNum)
+	}
+	var size int64
+	for _, node := range t.nodes[level] {
+		size += node.size
+	}
+	return float64(size) / float64(t.opts.levelTargetBytes(level))
+}
+
+// 复制节点列表 修改之后整体替换t.nodes 需要持有t.lock
+// 读请求拿到的旧列表不会被修改
+func (t *Lsm) cloneNodes() [][]*Node {
+	nodes := make([][]*Node, len(t.nodes))
+	for i := range t.nodes {
+		nodes[i] = append([]*Node(nil), t.nodes[i]...)
+	}
+	return nodes
+}
+
+// 从列表中移除指定的节点
+func removeNodes(nodes []*Node, removed []*Node) []*Node {
+	set := make(map[*Node]struct{}, len(removed))
+	for _, node := range removed {
+		set[node] = struct{}{}
+	}
+	var ans []*Node
+	for _, node := range nodes {
+		if _, ok := set[node]; !ok {
+			ans = append(ans, node)
+		}
+	}
+	return ans
 }
 
 // 获取所有数据并合并到下一个层次
-func (t *Lsm) getAllData(level int) error {
+// 合并期间不持有锁 完成之后整体替换节点列表
+func (t *Lsm) getAllData(c *compaction) error {
+	if len(c.inputs) == 1 && len(c.overlaps) == 0 {
+		return t.moveNode(c)
+	}
 	mem := NewMemTable()
-	mergeNode, fileNames := t.getMergeBlock(level)
-	for _, node := range mergeNode {
+	for _, node := range append(c.inputs, c.overlaps...) {
 		m, err := node.Merge()
 		if err != nil {
 			return err
 		}
 		mem.Merge(m)
-		node.sstReader.Close()
+	}
+	mem = dropObsoleteVersions(mem, t.snapshotSeqs(), c.bottommost)
+
+	var outputs []*Node
+	for _, records := range splitRecords(mem.GetRecords(), t.opts.targetFileSize) {
+		m := NewMemTable()
+		for _, record := range records {
+			m.Set(record)
+		}
+		node, err := t.writeNode(m, c.level+1)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, node)
 	}
 
-	if err := t.sync(mem, level+1, t.sstSeq[level+1].Load()); err != nil {
+	edit := &versionEdit{}
+	for _, node := range append(c.inputs, c.overlaps...) {
+		edit.deleteFile(node)
+	}
+	for _, node := range outputs {
+		edit.addFile(node)
+	}
+	err := t.logAndApply(edit, func(nodes [][]*Node) {
+		nodes[c.level] = removeNodes(nodes[c.level], c.inputs)
+		nodes[c.level+1] = append(removeNodes(nodes[c.level+1], c.overlaps), outputs...)
+		sortNodes(nodes[c.level+1])
+	})
+	if err != nil {
 		return err
 	}
-	t.sstSeq[level+1].Add(1)
-	// 清理旧的节点和文件
-	for _, name := range fileNames {
-		_ = os.Remove(name)
+
+	// 清理旧的节点和文件 迭代器仍在使用时延迟到引用释放
+	for _, node := range append(c.inputs, c.overlaps...) {
+		node.unref()
 	}
-	t.nodes[level] = []*Node{}
 	return nil
 }
 
-// 将 MemTable 同步到磁盘
-func (t *Lsm) sync(mem *MemTable, level int, seq int32) error {
+// 只有一个输入文件并且下一层没有与之重叠的文件时 直接移动到下一层
+// 文件名不包含层次 只需要在manifest中修改层次 不需要重写数据
+func (t *Lsm) moveNode(c *compaction) error {
+	node := c.inputs[0]
+	meta := nodeMeta(node)
+	meta.level = c.level + 1
+	edit := &versionEdit{}
+	edit.deleteFile(node)
+	edit.newFiles = append(edit.newFiles, meta)
+	return t.logAndApply(edit, func(nodes [][]*Node) {
+		node.level = c.level + 1
+		nodes[c.level] = removeNodes(nodes[c.level], c.inputs)
+		nodes[c.level+1] = append(nodes[c.level+1], node)
+		sortNodes(nodes[c.level+1])
+	})
+}
+
+// 按照目标大小切分records 同一个key的所有版本放在同一个文件中
+// 保证输出的文件之间key不重叠
+func splitRecords(records []*Record, target int) [][]*Record {
+	var result [][]*Record
+	start, size := 0, 0
+	for i, record := range records {
+		if size >= target && record.Key != records[i-1].Key {
+			result = append(result, records[start:i])
+			start, size = i, 0
+		}
+		size += len(record.Key) + len(record.Value)
+	}
+	if start < len(records) {
+		result = append(result, records[start:])
+	}
+	return result
+}
+
+// 清理不再需要的旧版本 snapshots为递增排列的快照seq
+// 每个key保留最新的版本 以及每个快照能看到的最新版本
+// bottommost时最新的版本如果是删除标记 并且没有快照能看到更旧的版本 可以直接丢弃
+func dropObsoleteVersions(mem *MemTable, snapshots []uint64, bottommost bool) *MemTable {
+	m := NewMemTable()
+	var last *Record
+	for _, record := range mem.GetRecords() {
+		newest := last == nil || last.Key != record.Key
+		keep := newest || visibleToSnapshot(snapshots, record.Seq, last.Seq)
+		last = record
+		if !keep {
+			continue
+		}
+		if newest && bottommost && record.RType == RecordDelete &&
+			(len(snapshots) == 0 || snapshots[0] >= record.Seq) {
+			continue
+		}
+		m.Set(record)
+	}
+	return m
+}
+
+// 判断是否存在快照s满足 seq <= s < newerSeq
+// 即该版本是快照s能看到的最新版本
+func visibleToSnapshot(snapshots []uint64, seq, newerSeq uint64) bool {
+	i := sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] >= seq
+	})
+	return i < len(snapshots) && snapshots[i] < newerSeq
+}
+
+// 将 MemTable 写入sst文件并创建节点 不修改节点列表
+func (t *Lsm) writeNode(mem *MemTable, level int) (*Node, error) {
 	// 生成 SST 文件名
-	sstFileName := t.sstFile(level, seq)
+	number := t.newFileNumber()
+	sstFileName := t.sstFile(number)
 	sstWriter, err := NewSSTWriter(sstFileName, t.opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer sstWriter.Close()
 
 	// 将 MemTable 落盘
 	sparseIndex, err := sstWriter.SyncMemTable(mem)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 创建 SSTReader
-	sstReader, err := NewSSTReader(sstFileName)
+	sstReader, err := newSSTReader(sstFileName, t.opts.mmapReads)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// 创建新节点并添加到节点列表
+	// 创建新节点
 	node, err := NewNode(sstFileName, sstReader, t.opts, sparseIndex)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	t.nodes[level] = append(t.nodes[level], node)
-
-	// 检查并进行下一个层次的合并操作
-	if err := t.compactLevel(level); err != nil {
-		return err
-	}
-
-	return nil
+	node.level, node.fileNumber = level, number
+	node.cacheMetaBlocks()
+	return node, nil
 }
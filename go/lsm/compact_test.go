@@ -0,0 +1,194 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestCompact_Scheduler(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(),
+		WithMaxSSTSize(200),
+		WithMaxLevelNum(4),
+		WithLevelBaseBytes(8*1024),
+		WithLevelMultiplier(4),
+		WithMaxBackgroundJobs(3),
+	)
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	m := map[string]string{}
+	for _, i := range util.RandomInts(3000, 1500) {
+		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
+		assert.Nil(t, db.Put(key, value))
+		m[key] = value
+	}
+	db.waitForCompact()
+
+	// 合并完成之后每一层的分数都小于1
+	db.lock.RLock()
+	deeper := 0
+	for level := range db.nodes {
+		assert.Less(t, db.levelScore(level), 1.0)
+		if level > 1 {
+			deeper += len(db.nodes[level])
+		}
+	}
+	assert.Greater(t, deeper, 0)
+	db.lock.RUnlock()
+	for key, value := range m {
+		val, err := db.Query(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestOptions_levelTargetBytes(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithLevelBaseBytes(100), WithLevelMultiplier(10))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), opts.levelTargetBytes(1))
+	assert.Equal(t, int64(1000), opts.levelTargetBytes(2))
+	assert.Equal(t, int64(10000), opts.levelTargetBytes(3))
+}
+
+func TestCompact_Leveled(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(),
+		WithMaxSSTSize(200),
+		WithMaxLevelNum(4),
+		WithLevelBaseBytes(4*1024),
+		WithLevelMultiplier(4),
+		WithTargetFileSize(1000),
+	)
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	m := map[string]string{}
+	for _, i := range util.RandomInts(3000, 1500) {
+		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
+		assert.Nil(t, db.Put(key, value))
+		m[key] = value
+	}
+	for _, i := range util.RandomInts(500, 1500) {
+		key := util.GenerateKeyString(i)
+		assert.Nil(t, db.Delete(key))
+		delete(m, key)
+	}
+	db.waitForCompact()
+
+	// level0之外的层次有序并且互不重叠
+	db.lock.RLock()
+	for level := 1; level < len(db.nodes); level++ {
+		nodes := db.nodes[level]
+		for i := 1; i < len(nodes); i++ {
+			assert.Less(t, nodes[i-1].endKey, nodes[i].startKey)
+		}
+		if level > 1 && len(nodes) > 1 {
+			t.Logf("level %d has %d files", level, len(nodes))
+		}
+	}
+	db.lock.RUnlock()
+	for i := range 1500 {
+		key := util.GenerateKeyString(i)
+		val, err := db.Query(key)
+		if value, ok := m[key]; ok {
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		} else {
+			assert.Equal(t, ErrorNotExist, err)
+		}
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	records := []*Record{
+		{Key: "a", Value: "1234", Seq: 3},
+		{Key: "a", Value: "1234", Seq: 1},
+		{Key: "b", Value: "1234", Seq: 2},
+		{Key: "c", Value: "1234", Seq: 4},
+	}
+	parts := splitRecords(records, 5)
+	assert.Equal(t, 3, len(parts))
+	assert.Equal(t, 2, len(parts[0]))
+	assert.Equal(t, "b", parts[1][0].Key)
+}
+
+// 直接在指定层次安装sst 不触发后台合并
+func installNode(t *testing.T, db *Lsm, level int, seq uint64, records map[string]string) {
+	m := NewMemTable()
+	for key, value := range records {
+		r := &Record{Key: key, Value: value, RType: RecordUpdate, Seq: seq}
+		if value == "" {
+			r.RType = RecordDelete
+		}
+		m.Set(r)
+	}
+	node, err := db.writeNode(m, level)
+	assert.Nil(t, err)
+	edit := &versionEdit{}
+	edit.addFile(node)
+	assert.Nil(t, db.logAndApply(edit, func(nodes [][]*Node) {
+		nodes[level] = append(nodes[level], node)
+		sortNodes(nodes[level])
+	}))
+}
+
+func TestCompact_Bottommost(t *testing.T) {
+	// level1和level2标记为正在合并 后台协程不会选择 由测试直接执行合并
+	setup := func(deeper map[string]string) *Lsm {
+		opts, err := NewOptions(t.TempDir())
+		assert.Nil(t, err)
+		db := NewLsm(opts)
+		db.lock.Lock()
+		db.levelBusy[1], db.levelBusy[2] = true, true
+		db.lock.Unlock()
+		installNode(t, db, 1, 3, map[string]string{"k10": "new", "k20": "new"})
+		installNode(t, db, 2, 2, map[string]string{"k00": "v", "k40": "", "k50": "v"})
+		if deeper != nil {
+			installNode(t, db, 3, 1, deeper)
+		}
+		return db
+	}
+	compact := func(db *Lsm) *compaction {
+		db.lock.Lock()
+		c := db.newCompaction(1)
+		db.lock.Unlock()
+		assert.Nil(t, db.getAllData(c))
+		db.lock.Lock()
+		db.levelBusy[1], db.levelBusy[2] = false, false
+		db.lock.Unlock()
+		return c
+	}
+	tombstone := func(db *Lsm) bool {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		for _, node := range db.nodes[2] {
+			if r, err := node.Query("k40", MaxSeq); err == nil && r != nil {
+				return r.RType == RecordDelete
+			}
+		}
+		return false
+	}
+
+	// level3只与overlaps的范围重叠 删除标记需要保留 否则旧的版本重新出现
+	db := setup(map[string]string{"k35": "v", "k40": "OLD", "k45": "v"})
+	c := compact(db)
+	assert.Equal(t, 1, len(c.overlaps))
+	assert.False(t, c.bottommost)
+	assert.True(t, tombstone(db))
+	_, err := db.Query("k40")
+	assert.Equal(t, ErrorNotExist, err)
+	val, err := db.Query("k10")
+	assert.Nil(t, err)
+	assert.Equal(t, "new", val)
+	assert.Nil(t, db.Close())
+
+	// 更深的层次没有重叠时删除标记可以丢弃
+	db = setup(nil)
+	c = compact(db)
+	assert.True(t, c.bottommost)
+	assert.False(t, tombstone(db))
+	_, err = db.Query("k40")
+	assert.Equal(t, ErrorNotExist, err)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,41 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+const LockFileName = "LOCK"
+
+var ErrLocked = errors.New("lsm directory already locked")
+var ErrLockUnsupported = errors.New("lsm directory locking not supported on this platform")
+
+// fileLock 数据目录的排他锁 同一个目录同时只能被一个Lsm打开
+type fileLock struct {
+	fp *os.File
+}
+
+// lockDir 对dirPath下的LOCK文件加锁 已经被其他实例持有时返回ErrLocked
+// 平台不支持文件锁时返回ErrLockUnsupported
+func lockDir(dirPath string) (*fileLock, error) {
+	fileName := path.Join(dirPath, LockFileName)
+	fp, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(fp); err != nil {
+		_ = fp.Close()
+		if errors.Is(err, ErrLockUnsupported) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s: %v", ErrLocked, fileName, err)
+	}
+	return &fileLock{fp: fp}, nil
+}
+
+// release 关闭文件即释放锁 LOCK文件保留
+func (l *fileLock) release() error {
+	return l.fp.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package lsm
+
+import "os"
+
+// 其他平台没有可用的文件锁 不能保证只有一个实例写入 拒绝打开 只读打开不需要加锁
+func lockFile(fp *os.File) error {
+	return ErrLockUnsupported
+}
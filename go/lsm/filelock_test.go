@@ -0,0 +1,27 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLsm_DirLock(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	assert.Nil(t, db.Put("a", "1"))
+
+	// 同一个目录不能被打开两次
+	_, err = DefaultLsmTree(opts)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// 关闭之后释放锁
+	assert.Nil(t, db.Close())
+	db, err = DefaultLsmTree(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	val, err := db.Query("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", val)
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package lsm
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock对同一个文件的不同打开互斥 同一个进程中重复打开也会失败
+func lockFile(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
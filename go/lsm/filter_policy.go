@@ -0,0 +1,133 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Filter 判断key是否可能存在 返回false时一定不存在
+type Filter interface {
+	MayContain(key []byte) bool
+}
+
+// FilterPolicy 过滤器的构建和解析方式 sst写入和读取时由Options决定
+// Name会写入文件 读取时名称不一致的过滤器会被忽略
+type FilterPolicy interface {
+	Name() string
+	CreateFilter(keys [][]byte) ([]byte, error)
+	NewFilter(data []byte) (Filter, error)
+}
+
+type bloomFilterPolicy struct {
+	bitsPerKey int
+}
+
+// NewBloomFilterPolicy 标准bloom filter
+func NewBloomFilterPolicy(bitsPerKey int) FilterPolicy {
+	return &bloomFilterPolicy{bitsPerKey: bitsPerKey}
+}
+
+func (p *bloomFilterPolicy) Name() string {
+	return "bloom"
+}
+
+func (p *bloomFilterPolicy) CreateFilter(keys [][]byte) ([]byte, error) {
+	bf := NewBloomFilterForKeys(len(keys), p.bitsPerKey)
+	for _, key := range keys {
+		bf.Add(key)
+	}
+	return bf.Marshal(), nil
+}
+
+func (p *bloomFilterPolicy) NewFilter(data []byte) (Filter, error) {
+	bf := new(BloomFilter)
+	if err := bf.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+type blockedBloomFilterPolicy struct {
+	bitsPerKey int
+}
+
+// NewBlockedBloomFilterPolicy cache友好的bloom filter
+func NewBlockedBloomFilterPolicy(bitsPerKey int) FilterPolicy {
+	return &blockedBloomFilterPolicy{bitsPerKey: bitsPerKey}
+}
+
+func (p *blockedBloomFilterPolicy) Name() string {
+	return "blocked_bloom"
+}
+
+func (p *blockedBloomFilterPolicy) CreateFilter(keys [][]byte) ([]byte, error) {
+	bf := NewBlockedBloomFilterForKeys(len(keys), p.bitsPerKey)
+	for _, key := range keys {
+		bf.Add(key)
+	}
+	return bf.Marshal(), nil
+}
+
+func (p *blockedBloomFilterPolicy) NewFilter(data []byte) (Filter, error) {
+	bf := new(BlockedBloomFilter)
+	if err := bf.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+type ribbonFilterPolicy struct {
+	bitsPerKey int
+}
+
+// NewRibbonFilterPolicy ribbon filter 相同误判率下比bloom filter更省空间 构建更慢
+// 每个key大约占用1.1个字节 bitsPerKey按照bloom filter的误判率换算为指纹位数
+func NewRibbonFilterPolicy(bitsPerKey int) FilterPolicy {
+	return &ribbonFilterPolicy{bitsPerKey: bitsPerKey}
+}
+
+func (p *ribbonFilterPolicy) Name() string {
+	return "ribbon"
+}
+
+func (p *ribbonFilterPolicy) CreateFilter(keys [][]byte) ([]byte, error) {
+	// bloom filter的误判率约为0.6185^bitsPerKey 即2^(-0.69*bitsPerKey)
+	f, err := NewRibbonFilter(keys, (p.bitsPerKey*69+50)/100)
+	if err != nil {
+		return nil, err
+	}
+	return f.Marshal(), nil
+}
+
+func (p *ribbonFilterPolicy) NewFilter(data []byte) (Filter, error) {
+	f := new(RibbonFilter)
+	if err := f.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// encodeFilterBlock 过滤器在sst中的格式 [name len u32][name][filter]
+func encodeFilterBlock(name string, filter []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, uint32(len(name)))
+	buf.WriteString(name)
+	buf.Write(filter)
+	return buf.Bytes()
+}
+
+// decodeFilterBlock 解析过滤器 policy为nil或者名称不一致时返回nil
+func decodeFilterBlock(policy FilterPolicy, data []byte) (Filter, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("filter block too short: %d", len(data))
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint32(len(data)-4) < n {
+		return nil, fmt.Errorf("filter block name length error: %d", n)
+	}
+	if policy == nil || string(data[4:4+n]) != policy.Name() {
+		return nil, nil
+	}
+	return policy.NewFilter(data[4+n:])
+}
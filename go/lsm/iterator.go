@@ -0,0 +1,557 @@
+package lsm
+
+import (
+	"sort"
+
+	"github.com/google/btree"
+)
+
+// internalIterator 内部迭代器 遍历的是原始record(包含删除标记)
+type internalIterator interface {
+	Valid() bool
+	SeekToFirst()
+	SeekToLast()
+	Seek(key string)
+	Next()
+	Prev()
+	Record() *Record
+	Error() error
+	Close() error
+}
+
+// memTableIterator 基于btree的快照进行遍历
+type memTableIterator struct {
+	tree *btree.BTree
+	cur  *Record
+}
+
+// 拷贝一份btree 后续写入不会影响迭代器
+func (t *MemTable) newIterator() *memTableIterator {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &memTableIterator{tree: t.data.Clone()}
+}
+
+func (it *memTableIterator) Valid() bool {
+	return it.cur != nil
+}
+func (it *memTableIterator) SeekToFirst() {
+	it.cur = toRecord(it.tree.Min())
+}
+func (it *memTableIterator) SeekToLast() {
+	it.cur = toRecord(it.tree.Max())
+}
+func (it *memTableIterator) Seek(key string) {
+	it.cur = nil
+	it.tree.AscendGreaterOrEqual(&Record{Key: key, Seq: MaxSeq}, func(item btree.Item) bool {
+		it.cur = item.(*Record)
+		return false
+	})
+}
+func (it *memTableIterator) Next() {
+	prev := it.cur
+	it.cur = nil
+	it.tree.AscendGreaterOrEqual(prev, func(item btree.Item) bool {
+		if !prev.Less(item) {
+			return true
+		}
+		it.cur = item.(*Record)
+		return false
+	})
+}
+func (it *memTableIterator) Prev() {
+	prev := it.cur
+	it.cur = nil
+	it.tree.DescendLessOrEqual(prev, func(item btree.Item) bool {
+		if !item.Less(prev) {
+			return true
+		}
+		it.cur = item.(*Record)
+		return false
+	})
+}
+func (it *memTableIterator) Record() *Record {
+	return it.cur
+}
+func (it *memTableIterator) Error() error {
+	return nil
+}
+func (it *memTableIterator) Close() error {
+	it.tree, it.cur = nil, nil
+	return nil
+}
+
+func toRecord(item btree.Item) *Record {
+	if item == nil {
+		return nil
+	}
+	return item.(*Record)
+}
+
+// nodeIterator 两层迭代器 先定位稀疏索引 再按需解码block
+// 只会读取[lo,hi)范围内的block 索引在第一次定位时读取
+type nodeIterator struct {
+	node       *Node
+	lower      string
+	upper      string
+	spareIndex []*SparseIndex // 为nil时还没有读取
+	lo         int
+	hi         int
+	index      int       // 当前block在稀疏索引中的位置
+	block      []*Record // 当前block的数据
+	pos        int       // 当前record在block中的位置
+	err        error
+}
+
+// 根据[lower,upper)过滤掉不相交的block upper为空表示不限制
+func (n *Node) newIterator(lower, upper string) *nodeIterator {
+	return &nodeIterator{node: n, lower: lower, upper: upper, index: -1}
+}
+
+// 读取稀疏索引并确定[lo,hi) 失败时记录错误
+func (it *nodeIterator) init() bool {
+	it.err = nil
+	if it.spareIndex != nil {
+		return true
+	}
+	index, err := it.node.index()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.spareIndex = index
+	it.lo = sort.Search(len(index), func(i int) bool {
+		return index[i].MaxKey >= it.lower
+	})
+	it.hi = len(index)
+	if it.upper != "" {
+		it.hi = sort.Search(len(index), func(i int) bool {
+			return index[i].MinKey >= it.upper
+		})
+	}
+	return true
+}
+
+// 判断节点是否与[lower,upper)相交
+func (n *Node) overlaps(lower, upper string) bool {
+	if n.endKey < lower {
+		return false
+	}
+	return upper == "" || n.startKey < upper
+}
+
+func (it *nodeIterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.block)
+}
+
+// 读取第i个block 越界时迭代器失效
+func (it *nodeIterator) loadBlock(i int) bool {
+	it.index, it.block, it.pos = i, nil, -1
+	if i < it.lo || i >= it.hi {
+		return false
+	}
+	mem, err := it.node.load(it.spareIndex[i].DataOffset)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.block = mem.GetRecords()
+	return true
+}
+func (it *nodeIterator) SeekToFirst() {
+	if it.init() && it.loadBlock(it.lo) {
+		it.pos = 0
+		it.skipEmptyForward()
+	}
+}
+func (it *nodeIterator) SeekToLast() {
+	if it.init() && it.loadBlock(it.hi-1) {
+		it.pos = len(it.block) - 1
+		it.skipEmptyBackward()
+	}
+}
+func (it *nodeIterator) Seek(key string) {
+	if !it.init() {
+		return
+	}
+	i := it.lo + sort.Search(it.hi-it.lo, func(i int) bool {
+		return it.spareIndex[it.lo+i].MaxKey >= key
+	})
+	if !it.loadBlock(i) {
+		return
+	}
+	it.pos = sort.Search(len(it.block), func(i int) bool {
+		return it.block[i].Key >= key
+	})
+	it.skipEmptyForward()
+}
+func (it *nodeIterator) Next() {
+	it.pos++
+	it.skipEmptyForward()
+}
+func (it *nodeIterator) Prev() {
+	it.pos--
+	it.skipEmptyBackward()
+}
+func (it *nodeIterator) skipEmptyForward() {
+	for it.err == nil && it.pos >= len(it.block) {
+		if !it.loadBlock(it.index + 1) {
+			return
+		}
+		it.pos = 0
+	}
+}
+func (it *nodeIterator) skipEmptyBackward() {
+	for it.err == nil && it.pos < 0 {
+		if !it.loadBlock(it.index - 1) {
+			return
+		}
+		it.pos = len(it.block) - 1
+	}
+}
+func (it *nodeIterator) Record() *Record {
+	return it.block[it.pos]
+}
+func (it *nodeIterator) Error() error {
+	return it.err
+}
+func (it *nodeIterator) Close() error {
+	it.block = nil
+	return nil
+}
+
+type direction int
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// mergingIterator 多路归并 相同key时seq大的排在前面
+// seq也相同时(同一份数据)按照children的顺序
+type mergingIterator struct {
+	children []internalIterator
+	current  int
+	dir      direction
+}
+
+func newMergingIterator(children []internalIterator) *mergingIterator {
+	return &mergingIterator{children: children, current: -1}
+}
+
+// 比较两个child当前所在的位置
+func (it *mergingIterator) compare(i, j int) int {
+	a, b := it.children[i].Record(), it.children[j].Record()
+	if a.Key < b.Key {
+		return -1
+	}
+	if a.Key > b.Key {
+		return 1
+	}
+	if a.Seq != b.Seq {
+		if a.Seq > b.Seq {
+			return -1
+		}
+		return 1
+	}
+	return i - j
+}
+func (it *mergingIterator) findSmallest() {
+	it.current = -1
+	for i, child := range it.children {
+		if !child.Valid() {
+			continue
+		}
+		if it.current < 0 || it.compare(i, it.current) < 0 {
+			it.current = i
+		}
+	}
+}
+func (it *mergingIterator) findLargest() {
+	it.current = -1
+	for i := len(it.children) - 1; i >= 0; i-- {
+		if !it.children[i].Valid() {
+			continue
+		}
+		if it.current < 0 || it.compare(i, it.current) > 0 {
+			it.current = i
+		}
+	}
+}
+func (it *mergingIterator) Valid() bool {
+	return it.current >= 0
+}
+func (it *mergingIterator) SeekToFirst() {
+	for _, child := range it.children {
+		child.SeekToFirst()
+	}
+	it.dir = forward
+	it.findSmallest()
+}
+func (it *mergingIterator) SeekToLast() {
+	for _, child := range it.children {
+		child.SeekToLast()
+	}
+	it.dir = reverse
+	it.findLargest()
+}
+func (it *mergingIterator) Seek(key string) {
+	for _, child := range it.children {
+		child.Seek(key)
+	}
+	it.dir = forward
+	it.findSmallest()
+}
+func (it *mergingIterator) Next() {
+	// 换向时需要把其余child移动到当前位置之后
+	if it.dir != forward {
+		key := it.Record().Key
+		for i, child := range it.children {
+			if i == it.current {
+				continue
+			}
+			child.Seek(key)
+			for child.Valid() && it.compare(i, it.current) <= 0 {
+				child.Next()
+			}
+		}
+		it.dir = forward
+	}
+	it.children[it.current].Next()
+	it.findSmallest()
+}
+func (it *mergingIterator) Prev() {
+	// 换向时需要把其余child移动到当前位置之前
+	if it.dir != reverse {
+		key := it.Record().Key
+		for i, child := range it.children {
+			if i == it.current {
+				continue
+			}
+			child.Seek(key)
+			if !child.Valid() {
+				child.SeekToLast()
+			}
+			for child.Valid() && it.compare(i, it.current) >= 0 {
+				child.Prev()
+			}
+		}
+		it.dir = reverse
+	}
+	it.children[it.current].Prev()
+	it.findLargest()
+}
+func (it *mergingIterator) Record() *Record {
+	return it.children[it.current].Record()
+}
+func (it *mergingIterator) Error() error {
+	for _, child := range it.children {
+		if err := child.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (it *mergingIterator) Close() error {
+	var err error
+	for _, child := range it.children {
+		if e := child.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Iterator 整个lsm的有序视图 隐藏删除标记 相同key只返回最新的数据
+type Iterator struct {
+	iter  *mergingIterator
+	nodes []*Node // 持有引用 防止compact期间文件被关闭
+	lower string  // 下界(包含)
+	upper string  // 上界(不包含) 为空表示不限制
+	seq   uint64  // 只能看到seq不大于该值的数据
+	dir   direction
+	valid bool
+	key   string // 反向遍历时保存的当前数据
+	value string
+	err   error // 创建时的错误 不为nil时迭代器为空
+}
+
+// NewIterator 创建迭代器 使用前需要先Seek
+func (t *Lsm) NewIterator() *Iterator {
+	return t.newIterator("", "", MaxSeq)
+}
+
+// 只会访问与[lower,upper)相交的节点
+func (t *Lsm) newIterator(lower, upper string, seq uint64) *Iterator {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.closed.Load() {
+		return &Iterator{iter: newMergingIterator(nil), lower: lower, upper: upper, seq: seq, err: ErrClosed}
+	}
+
+	children := []internalIterator{t.memTable.newIterator()}
+	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
+		children = append(children, t.rOnlyMemTable[i].memTable.newIterator())
+	}
+	var nodes []*Node
+	for _, level := range t.nodes {
+		for j := len(level) - 1; j >= 0; j-- {
+			if !level[j].overlaps(lower, upper) {
+				continue
+			}
+			level[j].ref()
+			nodes = append(nodes, level[j])
+			children = append(children, level[j].newIterator(lower, upper))
+		}
+	}
+	return &Iterator{
+		iter:  newMergingIterator(children),
+		nodes: nodes,
+		lower: lower,
+		upper: upper,
+		seq:   seq,
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+func (it *Iterator) SeekToFirst() {
+	it.Seek(it.lower)
+}
+func (it *Iterator) SeekToLast() {
+	it.dir = reverse
+	if it.upper == "" {
+		it.iter.SeekToLast()
+	} else {
+		it.iter.Seek(it.upper)
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else {
+			it.iter.SeekToLast()
+		}
+	}
+	it.findPrevUserEntry()
+}
+
+// Seek 定位到第一个大于等于key的位置
+func (it *Iterator) Seek(key string) {
+	if key < it.lower {
+		key = it.lower
+	}
+	it.dir = forward
+	it.iter.Seek(key)
+	it.findNextUserEntry(false, "")
+}
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	if it.dir == reverse {
+		// 反向时内部迭代器停在当前key之前
+		it.dir = forward
+		if it.iter.Valid() {
+			it.iter.Next()
+		} else {
+			it.iter.SeekToFirst()
+		}
+		it.findNextUserEntry(true, it.key)
+		return
+	}
+	key := it.iter.Record().Key
+	it.iter.Next()
+	it.findNextUserEntry(true, key)
+}
+func (it *Iterator) Prev() {
+	if !it.valid {
+		return
+	}
+	if it.dir == forward {
+		// 退回到当前key的所有版本之前
+		key := it.iter.Record().Key
+		for {
+			it.iter.Prev()
+			if !it.iter.Valid() || it.iter.Record().Key < key {
+				break
+			}
+		}
+		it.dir = reverse
+	}
+	it.findPrevUserEntry()
+}
+
+// 正向查找 相同key第一个出现的是seq最大的数据 删除则跳过该key
+func (it *Iterator) findNextUserEntry(skipping bool, skip string) {
+	for ; it.iter.Valid(); it.iter.Next() {
+		record := it.iter.Record()
+		if it.upper != "" && record.Key >= it.upper {
+			break
+		}
+		if record.Seq > it.seq || (skipping && record.Key <= skip) {
+			continue
+		}
+		if record.RType == RecordDelete {
+			skipping, skip = true, record.Key
+			continue
+		}
+		it.valid = true
+		return
+	}
+	it.valid = false
+}
+
+// 反向查找 相同key最后出现的是seq最大的数据
+func (it *Iterator) findPrevUserEntry() {
+	rType := RecordDelete
+	for ; it.iter.Valid(); it.iter.Prev() {
+		record := it.iter.Record()
+		if record.Key < it.lower || (rType != RecordDelete && record.Key < it.key) {
+			break
+		}
+		if record.Seq > it.seq {
+			continue
+		}
+		rType = record.RType
+		if rType == RecordDelete {
+			it.key, it.value = "", ""
+		} else {
+			it.key, it.value = record.Key, record.Value
+		}
+	}
+	if rType == RecordDelete {
+		it.valid = false
+		it.key, it.value = "", ""
+		it.dir = forward
+		return
+	}
+	it.valid = true
+}
+func (it *Iterator) Key() string {
+	if it.dir == reverse {
+		return it.key
+	}
+	return it.iter.Record().Key
+}
+func (it *Iterator) Value() string {
+	if it.dir == reverse {
+		return it.value
+	}
+	return it.iter.Record().Value
+}
+func (it *Iterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.iter.Error()
+}
+
+// Close 释放对sst节点的引用
+func (it *Iterator) Close() error {
+	err := it.iter.Close()
+	for _, node := range it.nodes {
+		node.unref()
+	}
+	it.nodes, it.valid = nil, false
+	return err
+}
@@ -0,0 +1,78 @@
+package lsm
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestIterator_case1(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(200), WithMaxLevelNum(3))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	dict := map[string]string{}
+	for _, i := range util.RandomInts(600, 300) {
+		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
+		assert.Nil(t, db.Put(key, value))
+		dict[key] = value
+	}
+	for _, i := range util.RandomInts(100, 300) {
+		key := util.GenerateKeyString(i)
+		assert.Nil(t, db.Delete(key))
+		delete(dict, key)
+	}
+	var keys []string
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	it := db.NewIterator()
+	defer it.Close()
+	var got []string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		assert.Equal(t, dict[it.Key()], it.Value())
+		got = append(got, it.Key())
+	}
+	assert.Nil(t, it.Error())
+	assert.Equal(t, keys, got)
+
+	got = got[:0]
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		assert.Equal(t, dict[it.Key()], it.Value())
+		got = append(got, it.Key())
+	}
+	for i := range got {
+		assert.Equal(t, keys[len(keys)-1-i], got[i])
+	}
+}
+
+func TestIterator_Seek(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(100))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	for i := 0; i < 100; i += 2 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Delete(util.GenerateKeyString(42)))
+
+	it := db.NewIterator()
+	defer it.Close()
+	it.Seek(util.GenerateKeyString(41))
+	assert.True(t, it.Valid())
+	assert.Equal(t, util.GenerateKeyString(44), it.Key())
+
+	// 换向遍历
+	it.Prev()
+	assert.True(t, it.Valid())
+	assert.Equal(t, util.GenerateKeyString(40), it.Key())
+	it.Next()
+	assert.Equal(t, util.GenerateKeyString(44), it.Key())
+
+	it.Seek(util.GenerateKeyString(99))
+	assert.False(t, it.Valid())
+}
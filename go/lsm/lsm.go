@@ -1,6 +1,7 @@
 package lsm
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
 	"os"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -19,19 +21,39 @@ const (
 )
 
 type ReadOnlyMemTable struct {
-	walFile  string
-	memTable *MemTable
+	walFile   string
+	walNumber uint64
+	memTable  *MemTable
 }
 type Lsm struct {
-	opts           *Options
-	lock           sync.RWMutex           //锁
-	memTable       *MemTable              //memtable信息
-	rOnlyMemTable  []*ReadOnlyMemTable    //只读的memtable
-	walWriter      *WalWriter             //wal写入
-	memTableIndex  int                    //index
-	memCompactChan chan *ReadOnlyMemTable //管道传递 todo：并发使用
-	nodes          [][]*Node              //节点配置
-	sstSeq         []atomic.Int32         //sst seq序号
+	opts               *Options
+	lock               sync.RWMutex        //锁
+	memTable           *MemTable           //memtable信息
+	rOnlyMemTable      []*ReadOnlyMemTable //只读的memtable
+	walWriter          *WalWriter          //wal写入
+	walNumber          uint64              //当前wal的文件编号
+	memCompactChan     chan struct{}       //通知后台协程落盘只读memtable
+	flushLock          sync.Mutex          //后台协程落盘期间持有
+	compactChan        chan struct{}       //通知合并协程
+	levelBusy          []bool              //正在合并的层次
+	compactPointer     []string            //每一层上次合并到的位置 轮流选择文件
+	nodes              [][]*Node           //节点配置 只能整体替换
+	nextFileNumber     atomic.Uint64       //下一个可以分配的文件编号 sst wal manifest共用
+	runningCompactions int                 //正在执行的合并数量
+	seq                uint64              //最新分配的序列号
+	snapLock           sync.Mutex          //保护snapshots
+	snapshots          *list.List          //存活的快照 按照seq递增
+	manifest           *Manifest           //记录文件集合的修改
+	manifestLock       sync.Mutex          //保证修改写入manifest和安装节点的顺序一致
+	logNumber          uint64              //编号小于logNumber的wal已经落盘
+	walDropped         []WalDropReport     //恢复wal时丢弃的数据
+	writeMu            sync.Mutex          //保护writers
+	writers            []*writer           //等待写入的请求 队首为leader
+	closed             atomic.Bool         //关闭之后所有操作返回ErrClosed
+	closeChan          chan struct{}       //关闭时通知后台协程退出
+	bgWait             sync.WaitGroup      //等待后台协程退出
+	dirLock            *fileLock           //数据目录的排他锁 关闭时释放
+	catchUpLock        sync.Mutex          //secondary同时只有一个追赶
 }
 
 func NewLsm(options *Options) *Lsm {
@@ -41,258 +63,673 @@ func NewLsm(options *Options) *Lsm {
 	}
 	return lsm
 }
-func DefaultLsmTree(opts *Options) (*Lsm, error) {
+func DefaultLsmTree(opts *Options) (_ *Lsm, err error) {
+	// 只读时不加锁 不会修改目录
+	var dirLock *fileLock
+	if !opts.readOnly {
+		if dirLock, err = lockDir(opts.dirPath); err != nil {
+			return nil, err
+		}
+	}
+	// 打开失败时释放锁 之后可以重新打开
+	defer func() {
+		if err != nil && dirLock != nil {
+			_ = dirLock.release()
+		}
+	}()
 	lsm := &Lsm{
 		opts:           opts,
 		rOnlyMemTable:  make([]*ReadOnlyMemTable, 0),
-		memTableIndex:  0,
-		memCompactChan: make(chan *ReadOnlyMemTable),
+		memCompactChan: make(chan struct{}, 1),
+		compactChan:    make(chan struct{}, 1),
+		levelBusy:      make([]bool, opts.maxLevel),
+		compactPointer: make([]string, opts.maxLevel),
 		nodes:          make([][]*Node, opts.maxLevel),
-		sstSeq:         make([]atomic.Int32, opts.maxLevel),
+		snapshots:      list.New(),
+		closeChan:      make(chan struct{}),
+		dirLock:        dirLock,
 	}
-	go lsm.compact()
 
+	state, err := lsm.recoverVersion()
+	if err != nil {
+		return nil, err
+	}
 	if err := lsm.LoadWal(); err != nil {
 		return nil, err
 	}
-	if err := lsm.LoadSST(); err != nil {
+	if opts.readOnly {
+		lsm.recoverSeq()
+		return lsm, nil
+	}
+	// 恢复之后写入新的manifest 旧的manifest和没有提交的文件不再使用
+	if err := lsm.newManifest(lsm.newFileNumber()); err != nil {
 		return nil, err
 	}
+	if err := lsm.removeObsoleteFiles(state); err != nil {
+		return nil, err
+	}
+	lsm.recoverSeq()
+
+	// 恢复完成之后再启动后台协程 旧的wal恢复出来的只读memtable需要落盘
+	lsm.bgWait.Add(1 + opts.maxBackgroundJobs)
+	go lsm.compact()
+	for range opts.maxBackgroundJobs {
+		go lsm.compactWorker()
+	}
+	if len(lsm.rOnlyMemTable) > 0 {
+		lsm.notifyCompact()
+	}
+	lsm.notifyCompaction()
 	return lsm, nil
 }
-func (t *Lsm) Put(key, value string) error {
-	record := &Record{
-		Key:   key,
-		Value: value,
-		RType: RecordUpdate,
+
+// 恢复序列号 取wal和sst中最大的序列号
+func (t *Lsm) recoverSeq() {
+	t.seq = t.memTable.MaxSeq()
+	for _, item := range t.rOnlyMemTable {
+		t.seq = max(t.seq, item.memTable.MaxSeq())
+	}
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			t.seq = max(t.seq, node.maxSeq)
+		}
 	}
-	return t.setRecord(record)
+}
+func (t *Lsm) Put(key, value string) error {
+	return t.PutWithOptions(defaultWriteOptions, key, value)
+}
+func (t *Lsm) PutWithOptions(opts *WriteOptions, key, value string) error {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return t.WriteWithOptions(opts, batch)
 }
 func (t *Lsm) Delete(key string) error {
-	record := &Record{
-		Key:   key,
-		RType: RecordDelete,
-	}
-	return t.setRecord(record)
+	return t.DeleteWithOptions(defaultWriteOptions, key)
+}
+func (t *Lsm) DeleteWithOptions(opts *WriteOptions, key string) error {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return t.WriteWithOptions(opts, batch)
 }
-func (t *Lsm) setRecord(record *Record) error {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	if _, err := t.walWriter.Write(record); err != nil {
 
-		return err
-	}
-	t.memTable.Set(record)
+// Write 原子写入batch 只写一条wal记录 并在同一个临界区内写入memtable
+// batch中的每条记录按顺序分配递增的序列号
+func (t *Lsm) Write(batch *WriteBatch) error {
+	return t.WriteWithOptions(defaultWriteOptions, batch)
+}
 
-	if !t.checkOverflow() {
+// WriteWithOptions 按照opts写入batch 并发的写入会合并为一次wal写入
+func (t *Lsm) WriteWithOptions(opts *WriteOptions, batch *WriteBatch) error {
+	if batch.Count() == 0 {
 		return nil
 	}
-	t.refreshMemTableLocked()
-	return nil
+	return t.write(opts, batch)
 }
 func (t *Lsm) checkOverflow() bool {
 	return t.memTable.Len() >= t.opts.maxSSTSize
 }
 func (t *Lsm) Query(key string) (string, error) {
+	return t.query(key, MaxSeq)
+}
+
+// 查询seq不大于指定序列号的最新数据
+func (t *Lsm) query(key string, seq uint64) (string, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
-	record := t.memTable.Query(key)
-	if record != nil {
-		if record.RType == RecordDelete {
-			return "", ErrorNotExist
-		}
-		return record.Value, nil
+	if t.closed.Load() {
+		return "", ErrClosed
+	}
+	record, err := t.get(key, seq)
+	if err != nil {
+		return "", err
 	}
+	if record == nil || record.RType == RecordDelete {
+		return "", ErrorNotExist
+	}
+	return record.Value, nil
+}
 
+// 查询key在seq时可见的最新版本
+// memtable中的数据总是比sst新 找到即可返回
+// sst按照层次查找 level0的文件可能重叠 取seq最大的版本
+func (t *Lsm) get(key string, seq uint64) (*Record, error) {
+	if record := t.memTable.QueryAt(key, seq); record != nil {
+		return record, nil
+	}
 	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
-		record := t.rOnlyMemTable[i].memTable.Query(key)
-		if record != nil {
-			if record.RType == RecordDelete {
-				return "", ErrorNotExist
-			}
-			return record.Value, nil
+		if record := t.rOnlyMemTable[i].memTable.QueryAt(key, seq); record != nil {
+			return record, nil
 		}
 	}
 
-	for _, nodes := range t.nodes {
-		for j := len(nodes) - 1; j >= 0; j-- {
-			node := nodes[j]
-			value, ok, err := node.Query(key)
-			if ok {
-				fmt.Println("node", node.fileName, key)
-				return value, err
-			}
-			if err != nil && !errors.Is(err, ErrorNotExist) {
-				return "", err
-			}
+	var latest *Record
+	for _, node := range t.nodes[0] {
+		record, err := node.Query(key, seq)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil && (latest == nil || record.Seq > latest.Seq) {
+			latest = record
 		}
 	}
-
-	return "", ErrorNotExist
+	if latest != nil {
+		return latest, nil
+	}
+	// 其余层次的文件互不重叠 二分查找唯一可能包含key的文件
+	for _, nodes := range t.nodes[1:] {
+		i := sort.Search(len(nodes), func(i int) bool {
+			return nodes[i].endKey >= key
+		})
+		if i == len(nodes) {
+			continue
+		}
+		record, err := nodes[i].Query(key, seq)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+	return nil, nil
 }
 
-// 不是并发来实现的来实现的 目前先使用这个
-// 并发会存在资源竞争 后续来完善即可
-func (t *Lsm) refreshMemTableLocked() {
-	t.syncMemTable(t.memTable)
+// 当前memtable转为只读 由后台协程落盘 写入不需要等待sst生成
+// 旧的wal刷盘之后再关闭 SyncWAL只需要处理当前的wal
+func (t *Lsm) refreshMemTableLocked() error {
+	if err := t.walWriter.Sync(); err != nil {
+		return err
+	}
 	t.walWriter.Close()
-	_ = os.Remove(t.walFile())
-	t.memTableIndex++
+	oldItem := &ReadOnlyMemTable{
+		walFile:   t.walFile(t.walNumber),
+		walNumber: t.walNumber,
+		memTable:  t.memTable,
+	}
+	t.rOnlyMemTable = append(t.rOnlyMemTable, oldItem)
 	t.newMemTable()
+	t.notifyCompact()
+	return nil
 }
-
-//	func (t *Lsm) refreshMemTableLocked() {
-//		oldItem := &ReadOnlyMemTable{
-//			walFile:  t.walFile(),
-//			memTable: t.memTable,
-//		}
-//		t.rOnlyMemTable = append(t.rOnlyMemTable, oldItem)
-//
-//		go func() {
-//			t.memCompactChan <- oldItem
-//		}()
-//		t.memTableIndex++
-//		t.newMemTable()
-//	}
 func (t *Lsm) newMemTable() {
-	t.walWriter, _ = NewWalWriter(t.walFile())
+	t.walNumber = t.newFileNumber()
+	t.walWriter, _ = NewWalWriter(t.walFile(t.walNumber))
 	t.memTable = NewMemTable()
 }
-func (t *Lsm) walFile() string {
-	return path.Join(t.opts.dirPath, WalFileName, fmt.Sprintf("%09d%s", t.memTableIndex, WalSuffix))
+
+// 分配新的文件编号 所有文件的编号单调递增 不会重复使用
+func (t *Lsm) newFileNumber() uint64 {
+	return t.nextFileNumber.Add(1) - 1
 }
-func (t *Lsm) sstFile(level int, seq int32) string {
-	return path.Join(t.opts.dirPath, fmt.Sprintf("%02d_%06d%s", level, seq, SSTSuffix))
+
+// 恢复时遇到的文件编号都视为已经使用
+func (t *Lsm) markFileNumberUsed(number uint64) {
+	for {
+		next := t.nextFileNumber.Load()
+		if number < next || t.nextFileNumber.CompareAndSwap(next, number+1) {
+			return
+		}
+	}
+}
+func (t *Lsm) walFile(number uint64) string {
+	return path.Join(t.opts.dirPath, WalFileName, fmt.Sprintf("%06d%s", number, WalSuffix))
+}
+
+// sst文件名只包含文件编号 合并时可以直接移动到下一层而不需要重命名
+func (t *Lsm) sstFile(number uint64) string {
+	return path.Join(t.opts.dirPath, fmt.Sprintf("%06d%s", number, SSTSuffix))
 }
 
-// 后台开启 进行操作 todo
+// 通知后台协程 已经有通知未处理时直接返回
+func (t *Lsm) notifyCompact() {
+	select {
+	case t.memCompactChan <- struct{}{}:
+	default:
+	}
+}
+
+// 后台开启 按照从旧到新的顺序落盘只读memtable
 func (t *Lsm) compact() {
+	defer t.bgWait.Done()
 	for {
 		select {
-		case item := <-t.memCompactChan:
-			t.compactMemTable(item)
+		case <-t.closeChan:
+			return
+		case <-t.memCompactChan:
+		}
+		if err := t.flushMemTables(); err != nil {
+			panic(err)
 		}
 	}
 }
-func (t *Lsm) compactMemTable(item *ReadOnlyMemTable) {
-	if err := t.syncMemTable(item.memTable); err != nil {
-		panic(err)
+
+// 按照从旧到新的顺序落盘所有只读memtable
+func (t *Lsm) flushMemTables() error {
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
+	for {
+		t.lock.RLock()
+		if len(t.rOnlyMemTable) == 0 {
+			t.lock.RUnlock()
+			return nil
+		}
+		item := t.rOnlyMemTable[0]
+		t.lock.RUnlock()
+
+		if err := t.compactMemTable(item); err != nil {
+			return err
+		}
 	}
+}
 
-	t.lock.Lock()
-	for i := 0; i < len(t.rOnlyMemTable); i++ {
-		if t.rOnlyMemTable[i].memTable != item.memTable {
-			continue
+// Flush 将当前memtable落盘到level0 返回时之前写入的数据都已经在sst中
+func (t *Lsm) Flush() error {
+	if t.opts.readOnly {
+		return ErrReadOnly
+	}
+	err := t.runExclusive(func() error {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if t.memTable.Count() == 0 {
+			return nil
 		}
-		t.rOnlyMemTable = t.rOnlyMemTable[i+1:]
+		return t.refreshMemTableLocked()
+	})
+	if err != nil {
+		return err
 	}
+	return t.flushMemTables()
+}
+
+// Close 停止后台协程 按照配置落盘memtable 之后关闭wal和所有文件
+// 正在执行的合并会先完成 关闭之后所有操作返回ErrClosed
+func (t *Lsm) Close() error {
+	return t.runExclusive(func() error {
+		t.catchUpLock.Lock()
+		defer t.catchUpLock.Unlock()
+		t.stopBackground()
+
+		// 迭代器持有的节点引用不会释放 只关闭文件
+		defer func() {
+			for _, nodes := range t.nodes {
+				for _, node := range nodes {
+					node.close()
+				}
+			}
+		}()
+		if t.opts.readOnly {
+			return nil
+		}
+
+		var errs []error
+		if !t.opts.avoidFlushOnClose {
+			if t.memTable.Count() > 0 {
+				t.lock.Lock()
+				errs = append(errs, t.refreshMemTableLocked())
+				t.lock.Unlock()
+			}
+			errs = append(errs, t.flushMemTables())
+		}
+		errs = append(errs, t.walWriter.Sync())
+		t.walWriter.Close()
+		t.manifest.Close()
+		errs = append(errs, t.dirLock.release())
+		return errors.Join(errs...)
+	})
+}
+
+// 先拒绝新的读写 再等待后台协程退出 正在执行的落盘和合并会先完成
+func (t *Lsm) stopBackground() {
+	t.lock.Lock()
+	t.closed.Store(true)
 	t.lock.Unlock()
+	close(t.closeChan)
+	t.bgWait.Wait()
+}
+
+// 等待只读memtable全部落盘 以及需要的合并全部完成
+func (t *Lsm) waitForCompact() {
+	for !t.idle() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.flushLock.Lock()
+	t.flushLock.Unlock()
+}
+
+// 没有需要落盘的memtable 也没有正在执行或者等待执行的合并
+func (t *Lsm) idle() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if len(t.rOnlyMemTable) > 0 || t.runningCompactions > 0 {
+		return false
+	}
+	for level := range t.nodes {
+		if t.levelScore(level) >= 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// 落盘只读memtable 新节点加入level0和移除memtable在同一个临界区内完成
+// 读请求总能在其中之一找到数据 修改写入manifest之后才能删除wal
+// 空的memtable不生成sst 只推进manifest中的wal编号
+func (t *Lsm) compactMemTable(item *ReadOnlyMemTable) error {
+	edit := &versionEdit{}
+	var node *Node
+	if item.memTable.Count() > 0 {
+		var err error
+		node, err = t.writeNode(item.memTable, 0)
+		if err != nil {
+			return err
+		}
+		edit.addFile(node)
+	}
+	edit.setLogNumber(item.walNumber + 1)
+	err := t.logAndApply(edit, func(nodes [][]*Node) {
+		if node != nil {
+			nodes[0] = append(nodes[0], node)
+		}
+		t.rOnlyMemTable = t.rOnlyMemTable[1:]
+	})
+	if err != nil {
+		return err
+	}
 
 	_ = os.Remove(item.walFile)
+	t.notifyCompaction()
+	return nil
 }
-func (t *Lsm) syncMemTable(mem *MemTable) error {
-	if err := t.sync(mem, 0, t.sstSeq[0].Load()); err != nil {
+
+// 将修改写入manifest 提交成功之后在同一个临界区内安装新的节点列表
+// install在持有t.lock时调用 参数为复制之后的节点列表
+func (t *Lsm) logAndApply(edit *versionEdit, install func(nodes [][]*Node)) error {
+	t.manifestLock.Lock()
+	defer t.manifestLock.Unlock()
+	edit.setNextFileNumber(t.nextFileNumber.Load())
+	if err := t.manifest.Append(edit); err != nil {
 		return err
 	}
-	t.sstSeq[0].Add(1)
+	t.lock.Lock()
+	nodes := t.cloneNodes()
+	install(nodes)
+	t.nodes = nodes
+	t.lock.Unlock()
 	return nil
 }
 
-func (t *Lsm) LoadWal() error {
-	dirPath := path.Join(t.opts.dirPath, WalFileName)
-	fs, err := os.ReadDir(dirPath)
+// 从manifest恢复sst文件列表 返回manifest记录的文件集合
+// 不在其中的sst是崩溃时没有提交的输出 恢复完成之后删除
+// 没有CURRENT时为新的目录 旧版本写入的目录返回ErrLegacyFormat
+func (t *Lsm) recoverVersion() (*versionState, error) {
+	number, err := readCurrent(t.opts.dirPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return newVersionState(), t.checkLegacyDir()
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(fs) == 0 {
-		t.newMemTable()
-		return nil
+	state, err := replayManifest(manifestFile(t.opts.dirPath, number))
+	if err != nil {
+		return nil, err
+	}
+	t.logNumber = state.logNumber
+	t.markFileNumberUsed(number)
+	if state.nextFileNumber > 0 {
+		t.markFileNumberUsed(state.nextFileNumber - 1)
+	}
+	for _, f := range state.files {
+		node, err := t.openNode(f.level, f.number)
+		if err != nil {
+			return nil, err
+		}
+		t.nodes[f.level] = append(t.nodes[f.level], node)
+	}
+	sort.Slice(t.nodes[0], func(i, j int) bool {
+		return t.nodes[0][i].fileNumber < t.nodes[0][j].fileNumber
+	})
+	for level := 1; level < len(t.nodes); level++ {
+		sortNodes(t.nodes[level])
+	}
+	return state, nil
+}
+
+// 打开manifest中记录的sst文件
+func (t *Lsm) openNode(level int, number uint64) (*Node, error) {
+	return t.openNodeFile(t.sstFile(number), level, number)
+}
+func (t *Lsm) openNodeFile(fileName string, level int, number uint64) (*Node, error) {
+	sstReader, err := newSSTReader(fileName, t.opts.mmapReads)
+	if err != nil {
+		return nil, err
+	}
+	node, err := NewNode(fileName, sstReader, t.opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	node.level, node.fileNumber = level, number
+	t.markFileNumberUsed(number)
+	node.cacheMetaBlocks()
+	return node, nil
+}
+
+// 删除不在manifest中的sst文件 以及新的manifest生效之后旧的manifest
+func (t *Lsm) removeObsoleteFiles(state *versionState) error {
+	fs, err := os.ReadDir(t.opts.dirPath)
+	if err != nil {
+		return err
 	}
-	var ls []string
 	for _, f := range fs {
 		if f.IsDir() {
 			continue
 		}
-		if path.Ext(f.Name()) == WalSuffix {
-			ls = append(ls, f.Name())
+		name := f.Name()
+		if path.Ext(name) == SSTSuffix {
+			if number, err := parseFileNumber(name, SSTSuffix); err == nil {
+				if _, ok := state.files[number]; ok {
+					continue
+				}
+			}
+		} else if !strings.HasPrefix(name, ManifestFileName+"-") || name == path.Base(t.manifest.dest.Name()) {
+			continue
+		}
+		if err := os.Remove(path.Join(t.opts.dirPath, name)); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+// 写入包含当前所有文件的新manifest
+func (t *Lsm) newManifest(number uint64) error {
+	edit := &versionEdit{}
+	edit.setLogNumber(t.logNumber)
+	edit.setNextFileNumber(t.nextFileNumber.Load())
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			edit.addFile(node)
+		}
+	}
+	m, err := createManifest(t.opts.dirPath, number, edit)
+	if err != nil {
+		return err
+	}
+	t.manifest = m
+	return nil
+}
+
+// BlockCacheStats block cache的命中情况和占用 没有使用block cache时返回零值
+func (t *Lsm) BlockCacheStats() CacheStats {
+	if t.opts.blockCache == nil {
+		return CacheStats{}
+	}
+	return t.opts.blockCache.Stats()
+}
+
+// WalRecoveryReport 打开时恢复wal丢弃的数据 每个有数据丢弃的wal一条
+func (t *Lsm) WalRecoveryReport() []WalDropReport {
+	return t.walDropped
+}
+
+// 按照编号从小到大返回wal文件编号
+func (t *Lsm) walNumbers() ([]uint64, error) {
+	fs, err := os.ReadDir(path.Join(t.opts.dirPath, WalFileName))
+	if t.opts.readOnly && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ls []uint64
+	for _, f := range fs {
+		if f.IsDir() || path.Ext(f.Name()) != WalSuffix {
+			continue
+		}
+		if number, err := parseFileNumber(f.Name(), WalSuffix); err == nil {
+			ls = append(ls, number)
+		}
+	}
 	sort.Slice(ls, func(i, j int) bool {
 		return ls[i] < ls[j]
 	})
-	for i, f := range ls {
-		walReader, err := NewWalReader(path.Join(dirPath, f))
+	return ls, nil
+}
+
+// LoadWal 恢复没有落盘的wal 最后一个wal作为当前memtable继续写入
+// 只读时只在内存中重放 不截断也不删除任何wal
+func (t *Lsm) LoadWal() error {
+	numbers, err := t.walNumbers()
+	if err != nil {
+		return err
+	}
+	var ls []uint64
+	for _, number := range numbers {
+		t.markFileNumberUsed(number)
+		// manifest记录已经落盘的wal 删除之前崩溃时会残留
+		if number < t.logNumber {
+			if t.opts.readOnly {
+				continue
+			}
+			if err := os.Remove(t.walFile(number)); err != nil {
+				return err
+			}
+			continue
+		}
+		ls = append(ls, number)
+	}
+	if len(ls) == 0 {
+		if t.opts.readOnly {
+			t.memTable = NewMemTable()
+			return nil
+		}
+		t.newMemTable()
+		return nil
+	}
+
+	cut := false
+	for i, number := range ls {
+		walReader, err := NewWalReader(t.walFile(number))
 		if err != nil {
 			return err
 		}
 		defer walReader.Close()
 
 		memtable := NewMemTable()
-		if err := walReader.RestoreToMemTable(memtable); err != nil {
+		if err := walReader.recover(memtable, t.opts.walRecoveryMode, cut); err != nil {
 			return err
 		}
-		if i == len(ls)-1 {
+		if walReader.dropped.Records > 0 || walReader.dropped.Bytes > 0 {
+			t.walDropped = append(t.walDropped, walReader.dropped)
+		}
+		if cut {
+			// 更早的wal中有损坏 这个wal中的数据不能恢复
+			if t.opts.readOnly {
+				continue
+			}
+			if err := os.Remove(t.walFile(number)); err != nil {
+				return err
+			}
+			continue
+		}
+		cut = walReader.cut
+		if i == len(ls)-1 || cut {
 			t.memTable = memtable
-			t.memTableIndex = getWalFileIndex(f)
-			t.walWriter, _ = NewWalWriter(path.Join(dirPath, f))
-		} else {
-			// 并发使用 todo：没有实现
-			compactItem := &ReadOnlyMemTable{
-				walFile:  f,
-				memTable: memtable,
+			t.walNumber = number
+			if t.opts.readOnly {
+				continue
+			}
+			// 截掉末尾丢弃的记录 之后追加的记录才能被正常读取
+			if err := os.Truncate(t.walFile(number), walReader.offset); err != nil {
+				return err
+			}
+			t.walWriter, _ = NewWalWriter(t.walFile(number))
+		} else if memtable.Count() == 0 {
+			// 没有可以恢复的数据 例如只有DisableWAL的写入 不需要落盘
+			if t.opts.readOnly {
+				continue
 			}
-			t.rOnlyMemTable = append(t.rOnlyMemTable, compactItem)
-			t.memCompactChan <- compactItem
+			if err := os.Remove(t.walFile(number)); err != nil {
+				return err
+			}
+		} else {
+			// 旧的wal恢复为只读memtable 由后台协程落盘
+			t.rOnlyMemTable = append(t.rOnlyMemTable, &ReadOnlyMemTable{
+				walFile:   t.walFile(number),
+				walNumber: number,
+				memTable:  memtable,
+			})
 		}
 	}
 	return nil
 }
-func (t *Lsm) LoadSST() error {
+
+// 没有CURRENT时检查目录中是否有旧版本写入的数据
+// 旧版本的sst文件名为level_seq.sst wal和sst的编码都不兼容 不能直接打开
+func (t *Lsm) checkLegacyDir() error {
 	fs, err := os.ReadDir(t.opts.dirPath)
 	if err != nil {
 		return err
 	}
-
-	var ls []string
 	for _, f := range fs {
-		if f.IsDir() {
+		if f.IsDir() || path.Ext(f.Name()) != SSTSuffix {
 			continue
 		}
-		if path.Ext(f.Name()) == SSTSuffix {
-			ls = append(ls, f.Name())
+		if _, _, err := parseSstFile(f.Name()); err == nil {
+			return fmt.Errorf("%w: %s", ErrLegacyFormat, f.Name())
 		}
 	}
-	sort.Slice(ls, func(i, j int) bool {
-		return ls[i] < ls[j]
-	})
-	for _, f := range ls {
-		level, seq, err := parseSstFile(f)
-		if err != nil {
-			return err
-		}
-		sstReader, err := NewSSTReader(path.Join(t.opts.dirPath, f))
-		if err != nil {
-			return err
-		}
-		node, err := NewNode(path.Join(t.opts.dirPath, f), sstReader, t.opts, nil)
-		if err != nil {
-			return err
-		}
-		t.sstSeq[level].Store(seq)
-		t.nodes[level] = append(t.nodes[level], node)
-	}
-	if len(ls) == 0 {
+	fs, err = os.ReadDir(path.Join(t.opts.dirPath, WalFileName))
+	if t.opts.readOnly && errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if !f.IsDir() && isLegacyWal(f.Name()) {
+			return fmt.Errorf("%w: %s", ErrLegacyFormat, path.Join(WalFileName, f.Name()))
+		}
+	}
 	return nil
 }
-func getWalFileIndex(walFile string) int {
-	rawIndex := strings.Replace(walFile, WalSuffix, "", -1)
-	index, _ := strconv.Atoi(rawIndex)
-	return index
+
+// 旧版本的wal文件名补齐为9位 新的文件名补齐为6位 编号达到9位时不会以0开头
+func isLegacyWal(fileName string) bool {
+	baseName := strings.TrimSuffix(fileName, WalSuffix)
+	if baseName == fileName || len(baseName) != 9 || baseName[0] != '0' {
+		return false
+	}
+	_, err := strconv.ParseUint(baseName, 10, 64)
+	return err == nil
+}
+
+// 解析文件名中的编号
+func parseFileNumber(fileName, suffix string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSuffix(fileName, suffix), 10, 64)
 }
 
+// 解析旧版本的sst文件名 level_seq.sst
 func parseSstFile(fileName string) (int, int32, error) {
 	baseName := strings.TrimSuffix(fileName, SSTSuffix)
 	parts := strings.Split(baseName, "_")
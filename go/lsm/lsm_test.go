@@ -1,6 +1,9 @@
 package lsm
 
 import (
+	"os"
+	"path"
+	"runtime"
 	"testing"
 	"time"
 
@@ -13,6 +16,7 @@ func TestMemTable_Set(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	for i := range 100 {
 		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
 		err := db.Put(key, value)
@@ -49,6 +53,7 @@ func TestMemTable_Set1(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	m := map[string]string{}
 	for i := range 100 {
 		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
@@ -92,6 +97,7 @@ func TestMemTable_Set2(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	m := map[string]string{}
 	for i := range 500 {
 		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
@@ -143,6 +149,7 @@ func TestMemTable_Set3(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	m := map[string]string{}
 	for i := range 5900 {
 		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
@@ -178,12 +185,13 @@ func TestMemTable_Set3(t *testing.T) {
 	// 	}
 	// }
 	// t.Log(db.nodes)
-	// t.Log("db.sstSeq", db.sstSeq)
+	// t.Log("db.nextFileNumber", db.nextFileNumber.Load())
 }
 func TestMemTable_Get3(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	for i := range 809 {
 		key, _ := util.GenerateKeyString(i), util.GenerateValueString(12)
 
@@ -197,12 +205,13 @@ func TestMemTable_Get3(t *testing.T) {
 		}
 	}
 	t.Log(db.nodes)
-	t.Log("db.sstSeq", db.sstSeq)
+	t.Log("db.nextFileNumber", db.nextFileNumber.Load())
 }
 func TestMemTable_Get0(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 
 	for i := range 209 {
 		key, _ := util.GenerateKeyString(i), util.GenerateValueString(12)
@@ -221,6 +230,7 @@ func TestMemTable_Set4(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	//m := map[string]string{}
 	//for i := range 200 {
 	//	key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
@@ -245,12 +255,14 @@ func TestMemTable_Set5(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	t.Log(db)
 }
 func TestMemTable_Get1(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 
 	for i := range 209 {
 		key, _ := util.GenerateKeyString(i), util.GenerateValueString(12)
@@ -269,5 +281,226 @@ func TestMemTable_Get4(t *testing.T) {
 	opts, err := NewOptions("./data")
 	assert.Nil(t, err)
 	db := NewLsm(opts)
+	defer db.Close()
 	t.Log(db.nodes)
 }
+func TestLsm_Write(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir)
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	batch := NewWriteBatch()
+	for i := range 50 {
+		batch.Put(util.GenerateKeyString(i), util.GenerateValueString(12))
+	}
+	batch.Delete(util.GenerateKeyString(7))
+	assert.Equal(t, 51, batch.Count())
+	assert.Nil(t, db.Write(batch))
+
+	// 重新打开 从wal恢复
+	crash(db)
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	for i := range 50 {
+		val, err := db.Query(util.GenerateKeyString(i))
+		if i == 7 {
+			assert.Equal(t, ErrorNotExist, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, 12, len(val))
+		}
+	}
+}
+func TestLsm_Seq(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(100))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	key := util.GenerateKeyString(0)
+	assert.Nil(t, db.Put(key, "old"))
+	for i := 1; i < 20; i++ {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+
+	// 重新打开后分配的序列号必须比sst中的大
+	crash(db)
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	assert.Nil(t, db.Put(key, "new"))
+	for i := 1; i < 20; i++ {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	val, err := db.Query(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", val)
+}
+func TestLsm_BackgroundFlush(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithMaxSSTSize(100), WithMaxLevelNum(3))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	m := map[string]string{}
+	for i := range 1000 {
+		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
+		assert.Nil(t, db.Put(key, value))
+		m[key] = value
+	}
+	// 落盘期间数据依然可以从只读memtable中读到
+	for key, value := range m {
+		val, err := db.Query(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	// 落盘完成之后只剩下当前memtable对应的wal
+	db.waitForCompact()
+	fs, err := os.ReadDir(path.Join(dir, WalFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fs))
+	for key, value := range m {
+		val, err := db.Query(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+func TestLsm_Close(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(100))
+	assert.Nil(t, err)
+	goroutines := runtime.NumGoroutine()
+	db := NewLsm(opts)
+	for i := range 250 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Close())
+	// 关闭时memtable已经落盘 后台协程全部退出
+	assert.Equal(t, 0, db.memTable.Len())
+	assert.Equal(t, 0, len(db.rOnlyMemTable))
+	assert.Equal(t, goroutines, runtime.NumGoroutine())
+
+	assert.Equal(t, ErrClosed, db.Close())
+	assert.Equal(t, ErrClosed, db.Put("a", "1"))
+	assert.Equal(t, ErrClosed, db.Flush())
+	assert.Equal(t, ErrClosed, db.SyncWAL())
+	_, err = db.Query(util.GenerateKeyString(0))
+	assert.Equal(t, ErrClosed, err)
+	_, err = db.Scan("", "", 0)
+	assert.Equal(t, ErrClosed, err)
+
+	db = NewLsm(opts)
+	defer db.Close()
+	for i := range 250 {
+		_, err := db.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+}
+func TestLsm_AvoidFlushOnClose(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithAvoidFlushOnClose(true))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	assert.Nil(t, db.Put("a", "1"))
+	assert.Nil(t, db.Close())
+	assert.Equal(t, 1, db.memTable.Len())
+	for _, nodes := range db.nodes {
+		assert.Equal(t, 0, len(nodes))
+	}
+
+	// 没有落盘的数据从wal恢复
+	db = NewLsm(opts)
+	defer db.Close()
+	val, err := db.Query("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", val)
+}
+func TestLsm_Flush(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 10 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	assert.Equal(t, 0, db.memTable.Len())
+	assert.Equal(t, 1, len(db.nodes[0]))
+	// memtable为空时不生成新的文件
+	assert.Nil(t, db.Flush())
+	assert.Equal(t, 1, len(db.nodes[0]))
+	for i := range 10 {
+		_, err := db.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+	// 只有删除标记的memtable同样需要落盘
+	assert.Nil(t, db.Delete(util.GenerateKeyString(0)))
+	assert.Nil(t, db.Flush())
+	assert.Equal(t, 0, db.memTable.Count())
+	assert.Equal(t, 2, len(db.nodes[0]))
+	_, err = db.Query(util.GenerateKeyString(0))
+	assert.Equal(t, ErrorNotExist, err)
+}
+
+func TestLsm_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithMaxSSTSize(100))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 150 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Delete(util.GenerateKeyString(3)))
+	db.waitForCompact()
+
+	files := func() map[string]int64 {
+		m := map[string]int64{}
+		for _, dir := range []string{dir, path.Join(dir, WalFileName)} {
+			fs, err := os.ReadDir(dir)
+			assert.Nil(t, err)
+			for _, f := range fs {
+				info, err := f.Info()
+				assert.Nil(t, err)
+				m[f.Name()] = info.Size()
+			}
+		}
+		return m
+	}
+	before := files()
+
+	// 写入的实例持有目录锁 只读实例仍然可以打开
+	roOpts, err := NewOptions(dir, WithReadOnly(true))
+	assert.Nil(t, err)
+	ro, err := DefaultLsmTree(roOpts)
+	assert.Nil(t, err)
+	for i := range 150 {
+		_, err := ro.Query(util.GenerateKeyString(i))
+		if i == 3 {
+			assert.Equal(t, ErrorNotExist, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, ErrReadOnly, ro.Put("a", "1"))
+	assert.Equal(t, ErrReadOnly, ro.Delete("a"))
+	assert.Equal(t, ErrReadOnly, ro.Flush())
+	assert.Nil(t, ro.Close())
+	assert.Equal(t, before, files())
+
+	_, err = NewOptions(path.Join(dir, "missing"), WithReadOnly(true))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// 模拟进程崩溃 等待后台任务完成并停止后台协程 之后直接关闭所有文件
+// memtable不落盘 wal缓冲区中没有写入文件的数据丢失
+func crash(db *Lsm) {
+	db.waitForCompact()
+	db.stopBackground()
+	_ = db.walWriter.dest.Close()
+	for _, nodes := range db.nodes {
+		for _, node := range nodes {
+			node.close()
+		}
+	}
+	db.manifest.Close()
+	_ = db.dirLock.release()
+}
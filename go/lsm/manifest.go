@@ -0,0 +1,325 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	CurrentFileName  = "CURRENT"
+	ManifestFileName = "MANIFEST"
+)
+
+// versionEdit 中每个字段的标记
+const (
+	tagLogNumber      uint8 = 1
+	tagDeletedFile    uint8 = 2
+	tagNewFile        uint8 = 3
+	tagNextFileNumber uint8 = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// fileMeta 记录在manifest中的sst文件信息
+type fileMeta struct {
+	level    int
+	number   uint64 // 文件编号 不随层次变化
+	size     int64
+	startKey string
+	endKey   string
+	minSeq   uint64
+	maxSeq   uint64
+}
+
+func nodeMeta(node *Node) *fileMeta {
+	return &fileMeta{
+		level:    node.level,
+		number:   node.fileNumber,
+		size:     node.size,
+		startKey: node.startKey,
+		endKey:   node.endKey,
+		minSeq:   node.minSeq,
+		maxSeq:   node.maxSeq,
+	}
+}
+
+// versionEdit 一次落盘或者合并对文件集合的修改 作为一条记录原子写入manifest
+type versionEdit struct {
+	hasLogNumber      bool
+	logNumber         uint64 // 编号小于logNumber的wal已经落盘 恢复时不再需要
+	hasNextFileNumber bool
+	nextFileNumber    uint64 // 下一个可以分配的文件编号
+	deletedFiles      []*fileMeta
+	newFiles          []*fileMeta
+}
+
+func (e *versionEdit) setLogNumber(n uint64) {
+	e.hasLogNumber, e.logNumber = true, n
+}
+func (e *versionEdit) setNextFileNumber(n uint64) {
+	e.hasNextFileNumber, e.nextFileNumber = true, n
+}
+func (e *versionEdit) addFile(node *Node) {
+	e.newFiles = append(e.newFiles, nodeMeta(node))
+}
+func (e *versionEdit) deleteFile(node *Node) {
+	e.deletedFiles = append(e.deletedFiles, &fileMeta{level: node.level, number: node.fileNumber})
+}
+
+func (e *versionEdit) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+	if e.hasLogNumber {
+		binary.Write(buf, binary.LittleEndian, tagLogNumber)
+		binary.Write(buf, binary.LittleEndian, e.logNumber)
+	}
+	if e.hasNextFileNumber {
+		binary.Write(buf, binary.LittleEndian, tagNextFileNumber)
+		binary.Write(buf, binary.LittleEndian, e.nextFileNumber)
+	}
+	for _, f := range e.deletedFiles {
+		binary.Write(buf, binary.LittleEndian, tagDeletedFile)
+		binary.Write(buf, binary.LittleEndian, uint32(f.level))
+		binary.Write(buf, binary.LittleEndian, f.number)
+	}
+	for _, f := range e.newFiles {
+		binary.Write(buf, binary.LittleEndian, tagNewFile)
+		binary.Write(buf, binary.LittleEndian, uint32(f.level))
+		binary.Write(buf, binary.LittleEndian, f.number)
+		binary.Write(buf, binary.LittleEndian, uint64(f.size))
+		binary.Write(buf, binary.LittleEndian, f.minSeq)
+		binary.Write(buf, binary.LittleEndian, f.maxSeq)
+		binary.Write(buf, binary.LittleEndian, uint32(len(f.startKey)))
+		buf.WriteString(f.startKey)
+		binary.Write(buf, binary.LittleEndian, uint32(len(f.endKey)))
+		buf.WriteString(f.endKey)
+	}
+	return buf.Bytes()
+}
+
+func (e *versionEdit) Restore(data []byte) error {
+	buf := bytes.NewReader(data)
+	var tag uint8
+	for {
+		if err := binary.Read(buf, binary.LittleEndian, &tag); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch tag {
+		case tagLogNumber, tagNextFileNumber:
+			var n uint64
+			if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
+				return err
+			}
+			if tag == tagLogNumber {
+				e.setLogNumber(n)
+			} else {
+				e.setNextFileNumber(n)
+			}
+		case tagDeletedFile, tagNewFile:
+			var level uint32
+			f := &fileMeta{}
+			if err := binary.Read(buf, binary.LittleEndian, &level); err != nil {
+				return err
+			}
+			if err := binary.Read(buf, binary.LittleEndian, &f.number); err != nil {
+				return err
+			}
+			f.level = int(level)
+			if tag == tagDeletedFile {
+				e.deletedFiles = append(e.deletedFiles, f)
+				continue
+			}
+			var size uint64
+			for _, v := range []any{&size, &f.minSeq, &f.maxSeq} {
+				if err := binary.Read(buf, binary.LittleEndian, v); err != nil {
+					return err
+				}
+			}
+			f.size = int64(size)
+			var err error
+			if f.startKey, err = readString(buf); err != nil {
+				return err
+			}
+			if f.endKey, err = readString(buf); err != nil {
+				return err
+			}
+			e.newFiles = append(e.newFiles, f)
+		default:
+			return fmt.Errorf("unknown version edit tag: %d", tag)
+		}
+	}
+}
+
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// versionState 重放manifest得到的文件集合
+type versionState struct {
+	logNumber      uint64
+	nextFileNumber uint64
+	files          map[uint64]*fileMeta // key为文件编号
+}
+
+func newVersionState() *versionState {
+	return &versionState{files: make(map[uint64]*fileMeta)}
+}
+
+func (s *versionState) apply(e *versionEdit) {
+	if e.hasLogNumber {
+		s.logNumber = e.logNumber
+	}
+	if e.hasNextFileNumber {
+		s.nextFileNumber = e.nextFileNumber
+	}
+	for _, f := range e.deletedFiles {
+		delete(s.files, f.number)
+	}
+	for _, f := range e.newFiles {
+		s.files[f.number] = f
+	}
+}
+
+// Manifest versionEdit的日志 每条记录为[len u32][crc u32][edit]
+// CURRENT文件记录当前使用的manifest文件名
+type Manifest struct {
+	dirPath string
+	number  uint64
+	dest    *os.File
+}
+
+func manifestFile(dirPath string, number uint64) string {
+	return path.Join(dirPath, fmt.Sprintf("%s-%06d", ManifestFileName, number))
+}
+
+// createManifest 创建新的manifest 写入snapshot之后再切换CURRENT
+// 切换之前崩溃时仍然使用旧的manifest
+func createManifest(dirPath string, number uint64, snapshot *versionEdit) (*Manifest, error) {
+	fp, err := os.OpenFile(manifestFile(dirPath, number), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{dirPath: dirPath, number: number, dest: fp}
+	if err := m.Append(snapshot); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if err := setCurrent(dirPath, number); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// 先写临时文件再重命名 保证CURRENT总是完整的
+func setCurrent(dirPath string, number uint64) error {
+	tmp := path.Join(dirPath, CurrentFileName+".tmp")
+	content := path.Base(manifestFile(dirPath, number)) + "\n"
+	fp, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.WriteString(content); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(dirPath, CurrentFileName)); err != nil {
+		return err
+	}
+	return syncDir(dirPath)
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Append 写入一条versionEdit并刷盘 返回之后修改才算提交
+func (m *Manifest) Append(e *versionEdit) error {
+	body := e.Bytes()
+	buf := make([]byte, 8+len(body))
+	binary.LittleEndian.PutUint32(buf, uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(body, crcTable))
+	copy(buf[8:], body)
+	if _, err := m.dest.Write(buf); err != nil {
+		return err
+	}
+	return m.dest.Sync()
+}
+
+func (m *Manifest) Close() {
+	_ = m.dest.Close()
+}
+
+// readCurrent 读取CURRENT指向的manifest编号 不存在时返回os.ErrNotExist
+func readCurrent(dirPath string) (uint64, error) {
+	data, err := os.ReadFile(path.Join(dirPath, CurrentFileName))
+	if err != nil {
+		return 0, err
+	}
+	name := strings.TrimSuffix(string(data), "\n")
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, ManifestFileName+"-"), 10, 64)
+	if err != nil || !strings.HasPrefix(name, ManifestFileName+"-") {
+		return 0, fmt.Errorf("invalid CURRENT file: %q", data)
+	}
+	return number, nil
+}
+
+// replayManifest 重放manifest中的所有记录
+// 末尾不完整的记录是写入时崩溃造成的 对应的修改没有提交 直接丢弃
+func replayManifest(fileName string) (*versionState, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	state := newVersionState()
+	for len(data) >= 8 {
+		n := binary.LittleEndian.Uint32(data)
+		checksum := binary.LittleEndian.Uint32(data[4:])
+		if uint64(len(data)-8) < uint64(n) {
+			break
+		}
+		body := data[8 : 8+n]
+		if crc32.Checksum(body, crcTable) != checksum {
+			if len(data) == 8+int(n) {
+				break
+			}
+			return nil, fmt.Errorf("manifest %s corrupted", fileName)
+		}
+		e := &versionEdit{}
+		if err := e.Restore(body); err != nil {
+			return nil, err
+		}
+		state.apply(e)
+		data = data[8+n:]
+	}
+	return state, nil
+}
@@ -0,0 +1,200 @@
+package lsm
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestManifest_Replay(t *testing.T) {
+	dir := t.TempDir()
+	edit := &versionEdit{}
+	edit.setLogNumber(3)
+	edit.newFiles = append(edit.newFiles,
+		&fileMeta{level: 0, number: 1, size: 100, startKey: "a", endKey: "c", minSeq: 1, maxSeq: 10},
+		&fileMeta{level: 0, number: 2, size: 200, startKey: "b", endKey: "d", minSeq: 11, maxSeq: 20},
+	)
+	m, err := createManifest(dir, 1, edit)
+	assert.Nil(t, err)
+
+	edit = &versionEdit{}
+	edit.deletedFiles = append(edit.deletedFiles, &fileMeta{level: 0, number: 1}, &fileMeta{level: 0, number: 2})
+	edit.newFiles = append(edit.newFiles, &fileMeta{level: 1, number: 3, size: 300, startKey: "a", endKey: "d", minSeq: 1, maxSeq: 20})
+	assert.Nil(t, m.Append(edit))
+	m.Close()
+
+	number, err := readCurrent(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), number)
+	state, err := replayManifest(manifestFile(dir, number))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), state.logNumber)
+	assert.Equal(t, 1, len(state.files))
+	assert.Equal(t, &fileMeta{level: 1, number: 3, size: 300, startKey: "a", endKey: "d", minSeq: 1, maxSeq: 20}, state.files[3])
+
+	// 末尾写了一半的记录没有提交 重放时丢弃
+	data, err := os.ReadFile(manifestFile(dir, number))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(manifestFile(dir, number), data[:len(data)-3], os.ModePerm))
+	state, err = replayManifest(manifestFile(dir, number))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(state.files))
+}
+
+func TestLsm_ManifestRecovery(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithMaxSSTSize(100), WithMaxLevelNum(3))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	m := map[string]string{}
+	for i := range 1000 {
+		key, value := util.GenerateKeyString(i), util.GenerateValueString(12)
+		assert.Nil(t, db.Put(key, value))
+		m[key] = value
+	}
+	db.waitForCompact()
+
+	// 模拟崩溃时残留的合并输出 以及没有删除的已落盘wal
+	orphan := db.sstFile(999999)
+	assert.Nil(t, os.WriteFile(orphan, []byte("garbage"), os.ModePerm))
+	flushed := db.walFile(0)
+	assert.Nil(t, os.WriteFile(flushed, []byte("garbage"), os.ModePerm))
+
+	old := db.manifest.number
+	crash(db)
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	assert.Greater(t, db.manifest.number, old)
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(flushed)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(manifestFile(dir, old))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(manifestFile(dir, db.manifest.number))
+	assert.Nil(t, err)
+	for key, value := range m {
+		val, err := db.Query(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestLsm_FileNumber(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithMaxSSTSize(100), WithMaxLevelNum(3))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	for i := range 1000 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	db.waitForCompact()
+	next := db.nextFileNumber.Load()
+
+	crash(db)
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	assert.Greater(t, db.nextFileNumber.Load(), next)
+	fs, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, f := range fs {
+		if path.Ext(f.Name()) != SSTSuffix {
+			continue
+		}
+		number, err := parseFileNumber(f.Name(), SSTSuffix)
+		assert.Nil(t, err)
+		assert.Less(t, number, next)
+	}
+}
+
+func TestCompact_TrivialMove(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	m := NewMemTable()
+	for i := range 100 {
+		m.Set(&Record{Key: util.GenerateKeyString(i), Value: util.GenerateValueString(12), RType: RecordUpdate, Seq: uint64(i + 1)})
+	}
+	node, err := db.writeNode(m, 0)
+	assert.Nil(t, err)
+	edit := &versionEdit{}
+	edit.addFile(node)
+	assert.Nil(t, db.logAndApply(edit, func(nodes [][]*Node) {
+		nodes[0] = append(nodes[0], node)
+	}))
+
+	assert.Nil(t, db.getAllData(&compaction{level: 0, inputs: []*Node{node}}))
+	assert.Equal(t, 0, len(db.nodes[0]))
+	assert.Equal(t, 1, len(db.nodes[1]))
+	assert.True(t, db.nodes[1][0] == node)
+	assert.Equal(t, 1, node.level)
+	_, err = os.Stat(node.fileName)
+	assert.Nil(t, err)
+
+	// 重新打开之后文件在level1
+	crash(db)
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	assert.Equal(t, 1, len(db.nodes[1]))
+	assert.Equal(t, node.fileNumber, db.nodes[1][0].fileNumber)
+	for i := range 100 {
+		_, err := db.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestLsm_LegacyDir(t *testing.T) {
+	// testdata/legacy由没有manifest的旧版本写入 sst和wal的编码都不兼容
+	copyDir := func(src, dst string) {
+		assert.Nil(t, filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			target := path.Join(dst, strings.TrimPrefix(name, src))
+			if d.IsDir() {
+				return os.MkdirAll(target, os.ModePerm)
+			}
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, data, os.ModePerm)
+		}))
+	}
+	dir := t.TempDir()
+	copyDir("testdata/legacy", dir)
+	opts, err := NewOptions(dir)
+	assert.Nil(t, err)
+	_, err = DefaultLsmTree(opts)
+	assert.ErrorIs(t, err, ErrLegacyFormat)
+	// 不修改旧的文件
+	_, err = os.Stat(path.Join(dir, "00_000000.sst"))
+	assert.Nil(t, err)
+
+	// 只有wal的旧目录
+	dir = t.TempDir()
+	copyDir("testdata/legacy/wal_file", path.Join(dir, WalFileName))
+	opts, err = NewOptions(dir)
+	assert.Nil(t, err)
+	_, err = DefaultLsmTree(opts)
+	assert.ErrorIs(t, err, ErrLegacyFormat)
+	roOpts, err := NewOptions(dir, WithReadOnly(true))
+	assert.Nil(t, err)
+	_, err = DefaultLsmTree(roOpts)
+	assert.ErrorIs(t, err, ErrLegacyFormat)
+
+	// 打开失败时释放目录锁 删除旧的数据之后可以打开
+	assert.Nil(t, os.RemoveAll(path.Join(dir, WalFileName)))
+	opts, err = NewOptions(dir)
+	assert.Nil(t, err)
+	db, err := DefaultLsmTree(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
@@ -10,15 +10,21 @@ import (
 	"github.com/google/btree"
 )
 
+// 按照key升序 相同key按照seq降序 最新的版本排在最前面
 func (r *Record) Less(than btree.Item) bool {
-	return r.Key < than.(*Record).Key
+	other := than.(*Record)
+	if r.Key != other.Key {
+		return r.Key < other.Key
+	}
+	return r.Seq > other.Seq
 }
 
 // 结构体
 type MemTable struct {
-	data *btree.BTree //树
-	mu   sync.RWMutex //锁
-	size int          //容量
+	data   *btree.BTree //树
+	mu     sync.RWMutex //锁
+	size   int          //容量
+	maxSeq uint64       //最大的序列号
 }
 
 // 产生新的memtable
@@ -29,7 +35,7 @@ func NewMemTable() *MemTable {
 	}
 }
 
-// set
+// set 不同seq的数据作为不同的版本保存
 func (t *MemTable) Set(r *Record) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -39,19 +45,37 @@ func (t *MemTable) Set(r *Record) {
 		t.size -= len(old.(*Record).Value)
 	}
 	t.size += len(r.Value)
+	if r.Seq > t.maxSeq {
+		t.maxSeq = r.Seq
+	}
 }
 
-// 查询
+// 查询 返回最新的版本
 func (t *MemTable) Query(key string) *Record {
+	return t.QueryAt(key, MaxSeq)
+}
+
+// QueryAt 返回seq不大于指定序列号的最新版本
+func (t *MemTable) QueryAt(key string, seq uint64) *Record {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	item := &Record{Key: key}
-	found := t.data.Get(item)
-	if found == nil {
-		return nil
-	}
-	return found.(*Record)
+	var found *Record
+	t.data.AscendGreaterOrEqual(&Record{Key: key, Seq: seq}, func(item btree.Item) bool {
+		if record := item.(*Record); record.Key == key {
+			found = record
+		}
+		return false
+	})
+	return found
+}
+
+// 获取最大的序列号
+func (t *MemTable) MaxSeq() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.maxSeq
 }
 
 // 获取容量
@@ -62,6 +86,14 @@ func (t *MemTable) Len() int {
 	return t.size
 }
 
+// 记录的数量 只有删除标记时Len为0 但是仍然需要落盘
+func (t *MemTable) Count() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.data.Len()
+}
+
 // 将数据装维bytes
 func (t *MemTable) Bytes() []byte {
 	t.mu.RLock()
@@ -130,7 +162,7 @@ func (t *MemTable) Show() {
 
 	fmt.Println("memory table info!")
 	t.data.Ascend(func(item btree.Item) bool {
-		fmt.Printf("(%s:%v:%v)\n", item.(*Record).Key, item.(*Record).Value, item.(*Record).RType)
+		fmt.Printf("(%s)\n", item.(*Record).Show())
 		return true
 	})
 }
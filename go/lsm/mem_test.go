@@ -3,6 +3,8 @@ package lsm
 import (
 	"github.com/xia-Sang/lsm_go/util"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMemTable_Get(t *testing.T) {
@@ -24,3 +26,18 @@ func TestMemTable_Get(t *testing.T) {
 		t.Log(value)
 	}
 }
+
+func TestMemTable_QueryAt(t *testing.T) {
+	m := NewMemTable()
+	key := util.GenerateKeyString(1)
+	m.Set(&Record{Key: key, Value: "v1", RType: RecordUpdate, Seq: 1})
+	m.Set(&Record{Key: key, Value: "v2", RType: RecordUpdate, Seq: 5})
+	m.Set(&Record{Key: key, RType: RecordDelete, Seq: 9})
+
+	assert.Equal(t, RecordDelete, m.Query(key).RType)
+	assert.Equal(t, "v2", m.QueryAt(key, 8).Value)
+	assert.Equal(t, "v1", m.QueryAt(key, 4).Value)
+	assert.Nil(t, m.QueryAt(key, 0))
+	assert.Equal(t, uint64(9), m.MaxSeq())
+	assert.Equal(t, 3, len(m.GetRecords()))
+}
@@ -6,18 +6,27 @@ import (
 	"unsafe"
 )
 
-// SSTableMetaInfo 目前是没有写入过滤器信息
+// sstFormatVersion 文件格式变化时递增
+// 0为旧版本的格式 记录中没有序列号 元信息只有40字节
+const sstFormatVersion uint32 = 1
+
+// SSTableMetaInfo 文件末尾的元信息 记录数据 索引 过滤器的位置
+// Version在最后4个字节 不同版本的元信息长度不同时也能先读出版本
 type SSTableMetaInfo struct {
 	DataOffset    uint64 // data segment position
 	DataLength    uint64 // data segment length
 	IndexOffset   uint64 // sparse index position
 	IndexLength   uint64 // sparse index length
-	BlockKeyNum   uint16 // each block contains N keys
-	TableBlockNum uint16 // each table contains N blocks
+	MinSeq        uint64 // 最小的序列号
+	MaxSeq        uint64 // 最大的序列号
+	FilterOffset  uint64 // bloom filter position
+	FilterLength  uint64 // bloom filter length 为0时没有过滤器
+	BlockKeyNum   uint16 // 平均每个block中的记录数
+	TableBlockNum uint16 // 文件中block的数量
 	Version       uint32 // data version
 }
 
-// SizeOfMetaInfo 8+8+8+8+2+2+4=40
+// SizeOfMetaInfo 8*8+2+2+4=72
 var SizeOfMetaInfo = unsafe.Sizeof(SSTableMetaInfo{})
 
 func (mi *SSTableMetaInfo) Bytes() []byte {
@@ -26,6 +35,10 @@ func (mi *SSTableMetaInfo) Bytes() []byte {
 	binary.Write(buf, binary.LittleEndian, mi.DataLength)
 	binary.Write(buf, binary.LittleEndian, mi.IndexOffset)
 	binary.Write(buf, binary.LittleEndian, mi.IndexLength)
+	binary.Write(buf, binary.LittleEndian, mi.MinSeq)
+	binary.Write(buf, binary.LittleEndian, mi.MaxSeq)
+	binary.Write(buf, binary.LittleEndian, mi.FilterOffset)
+	binary.Write(buf, binary.LittleEndian, mi.FilterLength)
 	binary.Write(buf, binary.LittleEndian, mi.BlockKeyNum)
 	binary.Write(buf, binary.LittleEndian, mi.TableBlockNum)
 	binary.Write(buf, binary.LittleEndian, mi.Version)
@@ -37,6 +50,10 @@ func (mi *SSTableMetaInfo) Restore(data []byte) {
 	binary.Read(buf, binary.LittleEndian, &mi.DataLength)
 	binary.Read(buf, binary.LittleEndian, &mi.IndexOffset)
 	binary.Read(buf, binary.LittleEndian, &mi.IndexLength)
+	binary.Read(buf, binary.LittleEndian, &mi.MinSeq)
+	binary.Read(buf, binary.LittleEndian, &mi.MaxSeq)
+	binary.Read(buf, binary.LittleEndian, &mi.FilterOffset)
+	binary.Read(buf, binary.LittleEndian, &mi.FilterLength)
 	binary.Read(buf, binary.LittleEndian, &mi.BlockKeyNum)
 	binary.Read(buf, binary.LittleEndian, &mi.TableBlockNum)
 	binary.Read(buf, binary.LittleEndian, &mi.Version)
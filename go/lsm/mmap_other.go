@@ -0,0 +1,14 @@
+//go:build !unix
+
+package lsm
+
+import "os"
+
+// 其他平台不映射 退回到按位置读取
+func mmapFile(fp *os.File, size int64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package lsm
+
+import (
+	"os"
+	"syscall"
+)
+
+// 只读映射整个文件
+func mmapFile(fp *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(fp.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -1,8 +1,10 @@
 package lsm
 
 import (
-	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
 )
 
 type Node struct {
@@ -10,89 +12,212 @@ type Node struct {
 	fileName   string
 	startKey   string
 	endKey     string
-	sstReader  *SSTReader
+	minSeq     uint64
+	maxSeq     uint64
+	size       int64 // 文件大小
+	metaInfo   *SSTableMetaInfo
 	level      int
-	seq        int32
-	spareIndex []*SparseIndex
-	_cache     map[int]*MemTable
+	fileNumber uint64                      // 全局唯一的文件编号
+	spareIndex []*SparseIndex              // 索引和过滤器放在block cache中时为nil 通过index读取
+	filter     Filter                      // 为nil时没有过滤器
+	cached     bool                        // 索引和过滤器放在block cache中
+	hasFilter  bool                        // 放入block cache时是否有过滤器
+	refs       atomic.Int32                // 引用计数 lsm本身持有一个
+	handle     atomic.Pointer[tableHandle] // 只读实例在节点存在期间一直持有文件
 }
 
 func (n *Node) Show() {
-	for k, v := range n._cache {
-		fmt.Println(k)
-		v.Show()
+	index, err := n.index()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for i := range index {
+		mem, err := n.load(index[i].DataOffset)
+		if err != nil {
+			fmt.Println(i, err)
+			continue
+		}
+		fmt.Println(i)
+		mem.Show()
 	}
 }
+
+// NewNode 读取sst的元信息 之后sstReader交给table cache管理 可能被关闭之后重新打开
+// 只读实例的文件可能已经被写入的实例删除 不能重新打开 在节点关闭之前一直持有
 func NewNode(fileName string, sstReader *SSTReader, opts *Options, spareIndex []*SparseIndex) (*Node, error) {
 	n := &Node{
 		fileName:   fileName,
-		sstReader:  sstReader,
 		spareIndex: spareIndex,
-		_cache:     make(map[int]*MemTable),
 		opts:       opts,
 	}
+	n.refs.Store(1)
+	n.size = sstReader.size
 	var err error
-	n.spareIndex, err = n.sstReader.ReadBlock()
+	n.metaInfo, err = sstReader.ReadMetaInfo()
+	if err != nil {
+		return nil, err
+	}
+	n.minSeq, n.maxSeq = n.metaInfo.MinSeq, n.metaInfo.MaxSeq
+	n.spareIndex, err = sstReader.ReadBlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(n.spareIndex) == 0 {
+		return nil, fmt.Errorf("sst %s has no data block", fileName)
+	}
+	n.filter, err = sstReader.ReadFilter(opts.filterPolicy)
+	if err != nil {
+		return nil, err
+	}
 	n.startKey = n.spareIndex[0].MinKey
 	n.endKey = n.spareIndex[len(n.spareIndex)-1].MaxKey
-	return n, err
+	if opts.readOnly {
+		n.handle.Store(opts.tableCache.insert(fileName, sstReader))
+	} else {
+		opts.tableCache.add(fileName, sstReader)
+	}
+	return n, nil
 }
 
-func (n *Node) Query(key string) (string, bool, error) {
-	if n.startKey > key || n.endKey < key {
-		return "", false, nil
+// Query 返回key在seq时可见的最新版本 删除标记也会返回 由调用方判断
+// 同一个key的多个版本可能跨越多个block
+func (n *Node) Query(key string, seq uint64) (*Record, error) {
+	if n.startKey > key || n.endKey < key || n.minSeq > seq {
+		return nil, nil
 	}
-	for i := len(n.spareIndex) - 1; i >= 0; i-- {
-		if n.startKey > key || n.endKey < key {
-			continue
-		}
-		val, ok, err := n.load(i, key)
-		if ok {
-			return val, true, err
+	// 过滤器判断不存在时不需要读取block
+	filter, err := n.getFilter()
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil && !filter.MayContain([]byte(key)) {
+		return nil, nil
+	}
+	index, err := n.index()
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(index), func(i int) bool {
+		return index[i].MaxKey >= key
+	})
+	for ; i < len(index) && index[i].MinKey <= key; i++ {
+		mem, err := n.load(index[i].DataOffset)
+		if err != nil {
+			return nil, err
 		}
-		if err != nil && !errors.Is(err, ErrorNotExist) {
-			return "", false, err
+		if record := mem.QueryAt(key, seq); record != nil {
+			return record, nil
 		}
 	}
-	return "", false, nil
+	return nil, nil
 }
-func query(v *MemTable, key string) (string, bool, error) {
-	record := v.Query(key)
-	if record != nil {
-		if record.RType == RecordDelete {
-			return "", false, ErrorNotExist
+
+// 读取offset处的block 优先从block cache中获取
+func (n *Node) load(offset uint32) (*MemTable, error) {
+	cache := n.opts.blockCache
+	if cache != nil {
+		if v, ok := cache.Lookup(n.fileNumber, uint64(offset)); ok {
+			return v.(*MemTable), nil
 		}
-		return record.Value, true, nil
 	}
-	return "", false, nil
+	h, err := n.opts.tableCache.get(n.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer n.opts.tableCache.release(h)
+	mem, err := h.reader.readSSTBlock(offset)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.Insert(n.fileNumber, uint64(offset), mem, blockCharge(mem))
+	}
+	return mem, nil
 }
-func (n *Node) load(i int, key string) (string, bool, error) {
-	if v, ok := n._cache[i]; ok {
-		return query(v, key)
+
+// 索引和过滤器放入block cache 文件编号确定之后调用
+// 之后节点不再直接持有 查询时从block cache读取 被淘汰之后从文件重新读取
+func (n *Node) cacheMetaBlocks() {
+	cache := n.opts.blockCache
+	if cache == nil || !n.opts.cacheIndexAndFilter {
+		return
 	}
-	mem, err := n.sstReader.readSSTBlock(n.spareIndex[i].DataOffset)
+	n.insertMeta(n.metaInfo.IndexOffset, n.spareIndex, int(n.metaInfo.IndexLength))
+	if n.filter != nil {
+		n.insertMeta(n.metaInfo.FilterOffset, n.filter, int(n.metaInfo.FilterLength))
+	}
+	n.hasFilter = n.filter != nil
+	n.spareIndex, n.filter, n.cached = nil, nil, true
+}
+
+// 按照配置固定或者普通写入 固定的数据只在节点关闭时释放
+func (n *Node) insertMeta(offset uint64, value any, charge int) {
+	if n.opts.pinIndexAndFilter {
+		n.opts.blockCache.Pin(n.fileNumber, offset, value, charge)
+	} else {
+		n.opts.blockCache.Insert(n.fileNumber, offset, value, charge)
+	}
+}
+
+// 稀疏索引 不在block cache中时从文件读取
+func (n *Node) index() ([]*SparseIndex, error) {
+	if !n.cached {
+		return n.spareIndex, nil
+	}
+	if v, ok := n.opts.blockCache.Lookup(n.fileNumber, n.metaInfo.IndexOffset); ok {
+		return v.([]*SparseIndex), nil
+	}
+	h, err := n.opts.tableCache.get(n.fileName)
 	if err != nil {
-		return "", false, err
+		return nil, err
+	}
+	defer n.opts.tableCache.release(h)
+	index, err := h.reader.ReadBlock()
+	if err != nil {
+		return nil, err
 	}
-	n._cache[i] = mem
-	return query(mem, key)
+	n.insertMeta(n.metaInfo.IndexOffset, index, int(n.metaInfo.IndexLength))
+	return index, nil
 }
-func (n *Node) Merge() (*MemTable, error) {
-	m := NewMemTable()
-	if len(n._cache) != 0 {
-		for j := range n.opts.tableNum {
-			m.Merge(n._cache[j])
-		}
-		return m, nil
+
+// 过滤器 没有过滤器时返回nil 不在block cache中时从文件读取
+func (n *Node) getFilter() (Filter, error) {
+	if !n.cached || !n.hasFilter {
+		return n.filter, nil
+	}
+	if v, ok := n.opts.blockCache.Lookup(n.fileNumber, n.metaInfo.FilterOffset); ok {
+		return v.(Filter), nil
+	}
+	h, err := n.opts.tableCache.get(n.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer n.opts.tableCache.release(h)
+	filter, err := h.reader.ReadFilter(n.opts.filterPolicy)
+	if err != nil {
+		return nil, err
 	}
+	n.insertMeta(n.metaInfo.FilterOffset, filter, int(n.metaInfo.FilterLength))
+	return filter, nil
+}
 
-	var err error
-	n.spareIndex, err = n.sstReader.ReadBlock()
+// Merge 读取整个文件的数据
+// 在后台协程中执行 不经过block cache 避免合并的数据挤掉查询需要的block
+func (n *Node) Merge() (*MemTable, error) {
+	// 合并期间持有文件 不会被table cache关闭
+	h, err := n.opts.tableCache.get(n.fileName)
 	if err != nil {
 		return nil, err
 	}
-	for i := 0; i < len(n.spareIndex); i++ {
-		mem, err := n.sstReader.readSSTBlock(n.spareIndex[i].DataOffset)
+	defer n.opts.tableCache.release(h)
+	index, err := n.index()
+	if err != nil {
+		return nil, err
+	}
+	m := NewMemTable()
+	for i := 0; i < len(index); i++ {
+		mem, err := h.reader.readSSTBlock(index[i].DataOffset)
 		if err != nil {
 			return nil, err
 		}
@@ -101,3 +226,29 @@ func (n *Node) Merge() (*MemTable, error) {
 	}
 	return m, nil
 }
+
+func (n *Node) ref() {
+	n.refs.Add(1)
+}
+
+// 引用归零说明节点已经被合并 并且没有迭代器在使用 可以删除文件
+func (n *Node) unref() {
+	if n.refs.Add(-1) == 0 {
+		n.close()
+		// 只读实例不删除文件 文件由写入的实例管理
+		if !n.opts.readOnly {
+			_ = os.Remove(n.fileName)
+		}
+	}
+}
+
+// 关闭文件并释放节点在block cache中的所有数据 不删除文件
+func (n *Node) close() {
+	n.opts.tableCache.evict(n.fileName)
+	if h := n.handle.Swap(nil); h != nil {
+		n.opts.tableCache.release(h)
+	}
+	if n.opts.blockCache != nil {
+		n.opts.blockCache.EraseFile(n.fileNumber)
+	}
+}
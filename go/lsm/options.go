@@ -3,17 +3,43 @@ package lsm
 import (
 	"errors"
 	"github.com/xia-Sang/lsm_go/util"
+	"math"
+	"os"
 	"path"
 )
 
 var ErrorNotExist = errors.New("key not exist")
+var ErrClosed = errors.New("lsm closed")
+var ErrReadOnly = errors.New("lsm opened in read-only mode")
+var ErrNotSecondary = errors.New("lsm not opened as secondary")
+var ErrSSTVersion = errors.New("unsupported sst format version")
+var ErrLegacyFormat = errors.New("lsm directory written by a version without manifest")
 
 type Options struct {
-	dirPath     string //配置文件
-	maxSSTSize  int    //sst size
-	maxLevel    int    //最大等级
-	maxLevelNum int    //每一层最多sst数量
-	tableNum    int    // 一个sst 里面有block的个数
+	dirPath             string          //配置文件
+	maxSSTSize          int             //sst size
+	maxLevel            int             //最大等级
+	maxLevelNum         int             //level0最多sst数量
+	tableNum            int             // 已废弃 block按照blockSize切分
+	blockSize           int             //data block未压缩的目标大小 单位字节
+	maxBackgroundJobs   int             //后台并发合并的协程数量
+	levelBaseBytes      int64           //level1的目标大小
+	levelMultiplier     int             //每一层目标大小是上一层的倍数
+	targetFileSize      int             //合并时输出文件的目标大小
+	bloomBitsPerKey     int             //默认过滤器每个key占用的bit数 小于0时不生成过滤器
+	filterPolicy        FilterPolicy    //过滤器类型 默认为标准bloom filter
+	walRecoveryMode     WalRecoveryMode //wal损坏时的恢复方式
+	manualWalFlush      bool            //wal写入缓冲区之后不立即写入文件 由FlushWAL写入
+	avoidFlushOnClose   bool            //关闭时不落盘memtable 重新打开时从wal恢复
+	readOnly            bool            //只读打开 不修改目录中的任何文件
+	secondary           bool            //只读打开 并且可以追赶写入实例的修改
+	blockCacheSize      int             //block cache的容量 单位字节 小于0时不缓存
+	blockCache          *BlockCache     //所有节点共享的block cache
+	cacheIndexAndFilter bool            //索引和过滤器放在block cache中 计入容量 淘汰之后从文件读取
+	pinIndexAndFilter   bool            //放在block cache中的索引和过滤器不会被淘汰
+	maxOpenFiles        int             //同时打开的sst文件数量 小于0时不限制
+	tableCache          *tableCache     //按需打开sst文件
+	mmapReads           bool            //通过mmap读取sst文件
 }
 
 type Option func(*Options)
@@ -36,11 +62,115 @@ func WithMaxLevelNum(num int) Option {
 	}
 }
 
+// WithTableNum 不再生效 block按照未压缩的字节大小切分
+//
+// Deprecated: 使用WithBlockSize
 func WithTableNum(num int) Option {
 	return func(o *Options) {
 		o.tableNum = num
 	}
 }
+func WithMaxBackgroundJobs(num int) Option {
+	return func(o *Options) {
+		o.maxBackgroundJobs = num
+	}
+}
+
+func WithLevelBaseBytes(size int64) Option {
+	return func(o *Options) {
+		o.levelBaseBytes = size
+	}
+}
+
+func WithLevelMultiplier(multiplier int) Option {
+	return func(o *Options) {
+		o.levelMultiplier = multiplier
+	}
+}
+func WithTargetFileSize(size int) Option {
+	return func(o *Options) {
+		o.targetFileSize = size
+	}
+}
+func WithBloomBitsPerKey(bits int) Option {
+	return func(o *Options) {
+		o.bloomBitsPerKey = bits
+	}
+}
+func WithFilterPolicy(policy FilterPolicy) Option {
+	return func(o *Options) {
+		o.filterPolicy = policy
+	}
+}
+func WithWalRecoveryMode(mode WalRecoveryMode) Option {
+	return func(o *Options) {
+		o.walRecoveryMode = mode
+	}
+}
+func WithManualWalFlush(manual bool) Option {
+	return func(o *Options) {
+		o.manualWalFlush = manual
+	}
+}
+func WithAvoidFlushOnClose(avoid bool) Option {
+	return func(o *Options) {
+		o.avoidFlushOnClose = avoid
+	}
+}
+
+// WithReadOnly 只读打开已有的目录 wal只在内存中重放 不落盘也不合并
+// 不持有目录锁 可以和正在写入的实例同时打开
+func WithReadOnly(readOnly bool) Option {
+	return func(o *Options) {
+		o.readOnly = readOnly
+	}
+}
+
+// WithSecondary 以secondary方式打开 在只读的基础上通过TryCatchUpWithPrimary读取写入实例的最新数据
+func WithSecondary(secondary bool) Option {
+	return func(o *Options) {
+		o.secondary = secondary
+		o.readOnly = o.readOnly || secondary
+	}
+}
+func WithBlockCacheSize(size int) Option {
+	return func(o *Options) {
+		o.blockCacheSize = size
+	}
+}
+
+// WithCacheIndexAndFilterBlocks 索引和过滤器不再由节点常驻内存 和数据block一起受block cache容量限制
+// 没有block cache时不生效
+func WithCacheIndexAndFilterBlocks(cache bool) Option {
+	return func(o *Options) {
+		o.cacheIndexAndFilter = cache
+	}
+}
+
+// WithPinIndexAndFilterBlocks 索引和过滤器放在block cache中并且固定 查询时不会因为淘汰重新读取文件
+func WithPinIndexAndFilterBlocks(pin bool) Option {
+	return func(o *Options) {
+		o.pinIndexAndFilter = pin
+		o.cacheIndexAndFilter = o.cacheIndexAndFilter || pin
+	}
+}
+
+// WithMaxOpenFiles 只读实例不受限制 文件可能被写入的实例删除 节点存在期间一直打开
+func WithMaxOpenFiles(num int) Option {
+	return func(o *Options) {
+		o.maxOpenFiles = num
+	}
+}
+func WithMmapReads(mmap bool) Option {
+	return func(o *Options) {
+		o.mmapReads = mmap
+	}
+}
+func WithBlockSize(size int) Option {
+	return func(o *Options) {
+		o.blockSize = size
+	}
+}
 func (o *Options) defaultOptions() {
 	if o.maxLevelNum <= 0 {
 		o.maxLevelNum = 10
@@ -48,12 +178,58 @@ func (o *Options) defaultOptions() {
 	if o.tableNum <= 0 {
 		o.tableNum = 10
 	}
+	if o.blockSize <= 0 {
+		o.blockSize = 4 << 10
+	}
 	if o.maxLevel <= 0 {
 		o.maxLevel = 7
 	}
 	if o.maxSSTSize <= 0 {
 		o.maxSSTSize = 1024
 	}
+	if o.maxBackgroundJobs <= 0 {
+		o.maxBackgroundJobs = 2
+	}
+	if o.levelBaseBytes <= 0 {
+		o.levelBaseBytes = int64(10 * o.maxLevelNum * o.maxSSTSize)
+	}
+	if o.levelMultiplier <= 1 {
+		o.levelMultiplier = 10
+	}
+	if o.targetFileSize <= 0 {
+		o.targetFileSize = 2 * o.maxSSTSize
+	}
+	if o.bloomBitsPerKey == 0 {
+		o.bloomBitsPerKey = 10
+	}
+	if o.filterPolicy == nil && o.bloomBitsPerKey > 0 {
+		o.filterPolicy = NewBloomFilterPolicy(o.bloomBitsPerKey)
+	}
+	if o.blockCacheSize == 0 {
+		o.blockCacheSize = 8 << 20
+	}
+	if o.blockCache == nil && o.blockCacheSize > 0 {
+		o.blockCache = NewBlockCache(o.blockCacheSize)
+	}
+	if o.maxOpenFiles == 0 {
+		o.maxOpenFiles = 1000
+	}
+	if o.tableCache == nil {
+		capacity := o.maxOpenFiles
+		if capacity < 0 {
+			capacity = math.MaxInt
+		}
+		o.tableCache = newTableCache(capacity, o.mmapReads)
+	}
+}
+
+// 每一层的目标大小 level1为levelBaseBytes 之后逐层放大
+func (o *Options) levelTargetBytes(level int) int64 {
+	target := o.levelBaseBytes
+	for i := 1; i < level; i++ {
+		target *= int64(o.levelMultiplier)
+	}
+	return target
 }
 func NewOptions(dirPath string, opts ...Option) (*Options, error) {
 	options := &Options{dirPath: dirPath}
@@ -67,6 +243,11 @@ func NewOptions(dirPath string, opts ...Option) (*Options, error) {
 	return options, options.check()
 }
 func (o *Options) check() error {
+	// 只读时不创建目录
+	if o.readOnly {
+		_, err := os.Stat(o.dirPath)
+		return err
+	}
 	if err := util.MakeDirPath(o.dirPath); err != nil {
 		return err
 	}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 // 实现record记录信息
@@ -11,10 +12,14 @@ type Record struct {
 	Key   string     // key
 	Value string     // value
 	RType RecordType // 类型信息
+	Seq   uint64     // 写入时分配的序列号 越大越新
 }
 
+// MaxSeq 查询最新版本时使用的序列号
+const MaxSeq = math.MaxUint64
+
 func (r *Record) Show() string {
-	return fmt.Sprintf("%s:%v:%v", r.Key, r.Value, r.RType)
+	return fmt.Sprintf("%s:%v:%v:%d", r.Key, r.Value, r.RType, r.Seq)
 }
 
 type RecordType uint8 //record类型信息
@@ -28,6 +33,7 @@ const (
 func (r *Record) Bytes() (int, []byte) {
 	buf := bytes.NewBuffer(nil)
 	binary.Write(buf, binary.LittleEndian, r.RType)
+	binary.Write(buf, binary.LittleEndian, r.Seq)
 	binary.Write(buf, binary.LittleEndian, uint32(len(r.Key)))
 	buf.Write([]byte(r.Key))
 	if r.RType == RecordUpdate {
@@ -42,6 +48,7 @@ func (r *Record) Restore(data []byte) {
 	var n uint32
 	buf := bytes.NewBuffer(data)
 	binary.Read(buf, binary.LittleEndian, &r.RType)
+	binary.Read(buf, binary.LittleEndian, &r.Seq)
 	binary.Read(buf, binary.LittleEndian, &n)
 	r.Key = string(buf.Next(int(n)))
 	if r.RType == RecordUpdate {
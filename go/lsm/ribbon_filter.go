@@ -0,0 +1,124 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// ribbonWidth 每个key的系数向量宽度
+const ribbonWidth = 64
+
+// RibbonFilter standard ribbon filter
+// 每个key对应一个从start开始的64位系数向量c和r位的指纹f
+// 构建时求解线性方程组 使得所有key满足 XOR(solution[start+j] for c的第j位) == f
+// 查询时不满足等式的key一定不存在 误判率约为2^-r
+// 每个槽位用一个字节存储 r最多为8
+type RibbonFilter struct {
+	solution []byte
+	seed     uint32
+	bits     uint32 // 指纹位数r
+}
+
+// 构建失败时换一个seed并增加槽位重试
+const ribbonMaxAttempts = 16
+
+var errRibbonFailed = errors.New("ribbon filter construction failed")
+
+// NewRibbonFilter 为keys构建过滤器 r为指纹位数
+func NewRibbonFilter(keys [][]byte, r int) (*RibbonFilter, error) {
+	r = min(max(r, 1), 8)
+	slots := len(keys) + len(keys)/10 + ribbonWidth
+	for seed := uint32(0); seed < ribbonMaxAttempts; seed++ {
+		f := &RibbonFilter{seed: seed, bits: uint32(r)}
+		if f.build(keys, slots) {
+			return f, nil
+		}
+		slots += slots / 10
+	}
+	return nil, errRibbonFailed
+}
+
+// 计算key的起始位置 系数向量以及指纹
+// 系数向量最低位固定为1 表示从start开始
+func (f *RibbonFilter) hash(key []byte, slots int) (int, uint64, byte) {
+	lo, hi := murmur3.Sum128WithSeed(key, f.seed)
+	start := int(hi % uint64(slots-ribbonWidth+1))
+	fp := byte(hi>>32) & byte(1<<f.bits-1)
+	return start, lo | 1, fp
+}
+
+// 高斯消元 逐个插入方程 再回代求解
+func (f *RibbonFilter) build(keys [][]byte, slots int) bool {
+	coeffs := make([]uint64, slots)
+	results := make([]byte, slots)
+	for _, key := range keys {
+		i, c, r := f.hash(key, slots)
+		for {
+			if coeffs[i] == 0 {
+				coeffs[i], results[i] = c, r
+				break
+			}
+			c ^= coeffs[i]
+			r ^= results[i]
+			if c == 0 {
+				// 方程线性相关 重复的key指纹相同 可以忽略
+				if r != 0 {
+					return false
+				}
+				break
+			}
+			tz := bits.TrailingZeros64(c)
+			c >>= tz
+			i += tz
+		}
+	}
+	f.solution = make([]byte, slots)
+	for i := slots - 1; i >= 0; i-- {
+		if coeffs[i] == 0 {
+			continue
+		}
+		v := results[i]
+		for c := coeffs[i] >> 1; c != 0; c &= c - 1 {
+			v ^= f.solution[i+1+bits.TrailingZeros64(c)]
+		}
+		f.solution[i] = v
+	}
+	return true
+}
+
+// MayContain checks if an item might be in the filter
+func (f *RibbonFilter) MayContain(key []byte) bool {
+	i, c, r := f.hash(key, len(f.solution))
+	var v byte
+	for ; c != 0; c &= c - 1 {
+		v ^= f.solution[i+bits.TrailingZeros64(c)]
+	}
+	return v == r
+}
+
+// Marshal encodes the filter as [seed u32][bits u32][solution]
+func (f *RibbonFilter) Marshal() []byte {
+	data := make([]byte, 8+len(f.solution))
+	binary.LittleEndian.PutUint32(data, f.seed)
+	binary.LittleEndian.PutUint32(data[4:], f.bits)
+	copy(data[8:], f.solution)
+	return data
+}
+
+// Unmarshal decodes a filter written by Marshal
+func (f *RibbonFilter) Unmarshal(data []byte) error {
+	if len(data) < 8+ribbonWidth {
+		return fmt.Errorf("ribbon filter too short: %d", len(data))
+	}
+	f.seed = binary.LittleEndian.Uint32(data)
+	f.bits = binary.LittleEndian.Uint32(data[4:])
+	if f.bits == 0 || f.bits > 8 {
+		return fmt.Errorf("ribbon filter invalid bits: %d", f.bits)
+	}
+	f.solution = append([]byte(nil), data[8:]...)
+	return nil
+}
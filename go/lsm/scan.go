@@ -0,0 +1,38 @@
+package lsm
+
+// Scan 范围查询[start,end) end为空表示不限制上界 limit<=0表示不限制数量
+// 与范围不相交的sst节点和block不会被读取
+func (t *Lsm) Scan(start, end string, limit int) ([]*Record, error) {
+	it := t.newIterator(start, end, MaxSeq)
+	defer it.Close()
+
+	var records []*Record
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+		records = append(records, &Record{Key: it.Key(), Value: it.Value(), RType: RecordUpdate})
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ScanPrefix 查询所有以prefix开头的key
+func (t *Lsm) ScanPrefix(prefix string) ([]*Record, error) {
+	return t.Scan(prefix, prefixSuccessor(prefix), 0)
+}
+
+// prefixSuccessor 返回大于所有以prefix开头的key的最小字符串
+// prefix全部为0xff时没有上界 返回空
+func prefixSuccessor(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
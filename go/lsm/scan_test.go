@@ -0,0 +1,51 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestLsm_Scan(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(200))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	for i := range 300 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Delete(util.GenerateKeyString(105)))
+
+	records, err := db.Scan(util.GenerateKeyString(100), util.GenerateKeyString(110), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, len(records))
+	assert.Equal(t, util.GenerateKeyString(100), records[0].Key)
+	assert.Equal(t, util.GenerateKeyString(109), records[8].Key)
+
+	records, err = db.Scan(util.GenerateKeyString(100), "", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(records))
+	assert.Equal(t, util.GenerateKeyString(104), records[4].Key)
+}
+
+func TestLsm_ScanPrefix(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(200))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	for i := range 20 {
+		for j := range 10 {
+			assert.Nil(t, db.Put(fmt.Sprintf("user:%d:%d", i, j), util.GenerateValueString(12)))
+		}
+	}
+	records, err := db.ScanPrefix("user:12:")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(records))
+	for j, r := range records {
+		assert.Equal(t, fmt.Sprintf("user:12:%d", j), r.Key)
+	}
+	assert.Equal(t, "b", prefixSuccessor("a\xff"))
+	assert.Equal(t, "", prefixSuccessor("\xff"))
+}
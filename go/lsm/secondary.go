@@ -0,0 +1,89 @@
+package lsm
+
+import (
+	"sort"
+)
+
+// TryCatchUpWithPrimary 重新读取写入实例的manifest和wal 之后的查询可以看到追赶时已经写入的数据
+// 仍然打开的sst直接复用 写入实例删除的sst在没有迭代器引用之后关闭
+// 写入实例在追赶期间合并并删除了文件时返回错误 可以稍后重试
+func (t *Lsm) TryCatchUpWithPrimary() error {
+	if !t.opts.secondary {
+		return ErrNotSecondary
+	}
+	t.catchUpLock.Lock()
+	defer t.catchUpLock.Unlock()
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	number, err := readCurrent(t.opts.dirPath)
+	if err != nil {
+		return err
+	}
+	state, err := replayManifest(manifestFile(t.opts.dirPath, number))
+	if err != nil {
+		return err
+	}
+
+	t.lock.RLock()
+	existing := make(map[uint64]*Node)
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			existing[node.fileNumber] = node
+		}
+	}
+	t.lock.RUnlock()
+
+	nodes := make([][]*Node, len(t.nodes))
+	levels := make(map[*Node]int)
+	var opened []*Node
+	for _, f := range state.files {
+		node, ok := existing[f.number]
+		if !ok {
+			if node, err = t.openNode(f.level, f.number); err != nil {
+				for _, node := range opened {
+					node.unref()
+				}
+				return err
+			}
+			opened = append(opened, node)
+		}
+		delete(existing, f.number)
+		levels[node] = f.level
+		nodes[f.level] = append(nodes[f.level], node)
+	}
+	sort.Slice(nodes[0], func(i, j int) bool {
+		return nodes[0][i].fileNumber < nodes[0][j].fileNumber
+	})
+	for level := 1; level < len(nodes); level++ {
+		sortNodes(nodes[level])
+	}
+
+	// wal在单独的实例中重放 完成之后整体替换 重放期间不阻塞读
+	v := &Lsm{opts: t.opts, logNumber: state.logNumber}
+	if err := v.LoadWal(); err != nil {
+		for _, node := range opened {
+			node.unref()
+		}
+		return err
+	}
+
+	t.lock.Lock()
+	// 直接移动到下一层的文件只修改层次
+	for node, level := range levels {
+		node.level = level
+	}
+	t.nodes = nodes
+	t.memTable, t.rOnlyMemTable = v.memTable, v.rOnlyMemTable
+	t.walDropped = v.walDropped
+	t.logNumber = state.logNumber
+	t.recoverSeq()
+	t.lock.Unlock()
+
+	// 不再使用的文件 迭代器仍在使用时延迟到引用释放
+	for _, node := range existing {
+		node.unref()
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestLsm_Secondary(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithMaxSSTSize(100), WithMaxLevelNum(2))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 150 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	db.waitForCompact()
+
+	secOpts, err := NewOptions(dir, WithSecondary(true))
+	assert.Nil(t, err)
+	sec, err := DefaultLsmTree(secOpts)
+	assert.Nil(t, err)
+	defer sec.Close()
+	assert.Equal(t, ErrReadOnly, sec.Put("a", "1"))
+
+	// 写入实例继续写入 落盘并合并 secondary追赶之前看不到
+	for i := 150; i < 600; i++ {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Delete(util.GenerateKeyString(0)))
+	db.waitForCompact()
+	_, err = sec.Query(util.GenerateKeyString(599))
+	assert.Equal(t, ErrorNotExist, err)
+	_, err = sec.Query(util.GenerateKeyString(0))
+	assert.Nil(t, err)
+
+	assert.Nil(t, sec.TryCatchUpWithPrimary())
+	for i := 1; i < 600; i++ {
+		_, err := sec.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+	_, err = sec.Query(util.GenerateKeyString(0))
+	assert.Equal(t, ErrorNotExist, err)
+	assert.Equal(t, db.seq, sec.seq)
+	for level := range db.nodes {
+		assert.Equal(t, len(db.nodes[level]), len(sec.nodes[level]))
+	}
+
+	roOpts, err := NewOptions(dir, WithReadOnly(true))
+	assert.Nil(t, err)
+	ro, err := DefaultLsmTree(roOpts)
+	assert.Nil(t, err)
+	defer ro.Close()
+	assert.Equal(t, ErrNotSecondary, ro.TryCatchUpWithPrimary())
+}
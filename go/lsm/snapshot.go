@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"container/list"
+)
+
+// Snapshot 一致性读视图 只能看到创建时已经写入的数据
+// 使用完之后需要调用ReleaseSnapshot 否则compact会一直保留旧版本
+type Snapshot struct {
+	db   *Lsm
+	seq  uint64
+	elem *list.Element
+}
+
+// GetSnapshot 创建快照 读取seq和注册快照需要在同一个临界区内
+// 保证compact时看不到的快照 其seq一定不小于参与合并的所有数据
+func (t *Lsm) GetSnapshot() *Snapshot {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	t.snapLock.Lock()
+	defer t.snapLock.Unlock()
+	s := &Snapshot{db: t, seq: t.seq}
+	s.elem = t.snapshots.PushBack(s)
+	return s
+}
+
+// ReleaseSnapshot 释放快照 重复释放不会有影响
+func (t *Lsm) ReleaseSnapshot(s *Snapshot) {
+	t.snapLock.Lock()
+	defer t.snapLock.Unlock()
+	if s.elem == nil {
+		return
+	}
+	t.snapshots.Remove(s.elem)
+	s.elem = nil
+}
+
+// 获取所有存活快照的seq 递增排列
+func (t *Lsm) snapshotSeqs() []uint64 {
+	t.snapLock.Lock()
+	defer t.snapLock.Unlock()
+
+	seqs := make([]uint64, 0, t.snapshots.Len())
+	for e := t.snapshots.Front(); e != nil; e = e.Next() {
+		seqs = append(seqs, e.Value.(*Snapshot).seq)
+	}
+	return seqs
+}
+
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Query 查询快照时刻的数据
+func (s *Snapshot) Query(key string) (string, error) {
+	return s.db.query(key, s.seq)
+}
+
+// NewIterator 创建只能看到快照时刻数据的迭代器
+func (s *Snapshot) NewIterator() *Iterator {
+	return s.db.newIterator("", "", s.seq)
+}
@@ -0,0 +1,75 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestSnapshot_Query(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(100), WithMaxLevelNum(2))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.waitForCompact()
+	for i := range 10 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), "v1"))
+	}
+	snap := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snap)
+	for i := range 10 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), "v2"))
+	}
+	assert.Nil(t, db.Delete(util.GenerateKeyString(3)))
+
+	// 大量写入 触发落盘和多次合并
+	for i := 100; i < 400; i++ {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	for i := range 10 {
+		val, err := snap.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+		assert.Equal(t, "v1", val)
+	}
+	_, err = db.Query(util.GenerateKeyString(3))
+	assert.Equal(t, ErrorNotExist, err)
+	val, err := db.Query(util.GenerateKeyString(4))
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", val)
+
+	it := snap.NewIterator()
+	defer it.Close()
+	count := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		assert.Equal(t, "v1", it.Value())
+		count++
+	}
+	assert.Equal(t, 10, count)
+}
+
+func TestDropObsoleteVersions(t *testing.T) {
+	mem := NewMemTable()
+	for seq := uint64(1); seq <= 10; seq++ {
+		mem.Set(&Record{Key: "k", Value: "v", Seq: seq})
+	}
+	mem.Set(&Record{Key: "j", Value: "v", Seq: 11})
+
+	records := dropObsoleteVersions(mem, nil, false).GetRecords()
+	assert.Equal(t, 2, len(records))
+
+	// 快照3能看到seq3 快照7能看到seq7 快照10能看到最新的seq10
+	records = dropObsoleteVersions(mem, []uint64{3, 7, 10}, false).GetRecords()
+	var seqs []uint64
+	for _, r := range records {
+		seqs = append(seqs, r.Seq)
+	}
+	assert.Equal(t, []uint64{11, 10, 7, 3}, seqs)
+
+	// 最底层的删除标记 没有快照需要旧版本时可以丢弃
+	mem.Set(&Record{Key: "k", RType: RecordDelete, Seq: 12})
+	records = dropObsoleteVersions(mem, nil, true).GetRecords()
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "j", records[0].Key)
+	records = dropObsoleteVersions(mem, []uint64{11}, true).GetRecords()
+	assert.Equal(t, 3, len(records))
+}
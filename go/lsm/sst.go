@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/pierrec/lz4"
 	"io"
+	"math"
 	"os"
 )
 
@@ -50,65 +51,60 @@ func (w *SSTWriter) syncMemTable(mem *MemTable) error {
 	return nil
 }
 func (w *SSTWriter) SyncMemTable(mem *MemTable) ([]*SparseIndex, error) {
-	// 实现一个最简单的数据落盘，直接将所有数据落盘即可
-
 	var sparseIndex []*SparseIndex
 
+	// 记录依次写入当前block 未压缩的大小达到blockSize时压缩写入文件
+	// 最后写入的记录较大时block会超过blockSize
 	records := mem.GetRecords()
-	divRecs := divRecords(records, w.opts.tableNum)
-
-	offset := 0
-	for i, res := range divRecs {
-		temp := bytes.NewBuffer(nil)
-		for _, re := range res {
-			length, data := re.Bytes()
-			count, err := temp.Write(data)
-			if err != nil {
-				return nil, fmt.Errorf("failed to write record data: %w", err)
-			}
-			if length != count {
-				return nil, errors.New("writer error: length mismatch")
-			}
+	block := bytes.NewBuffer(nil)
+	offset, start := 0, 0
+	for i, re := range records {
+		length, data := re.Bytes()
+		count, err := block.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write record data: %w", err)
 		}
-
-		w.lz4Buf.Reset()
-		lz4w := lz4.NewWriter(w.lz4Buf)
-		if _, err := lz4w.Write(temp.Bytes()); err != nil {
-			return nil, fmt.Errorf("failed to compress data: %w", err)
+		if length != count {
+			return nil, errors.New("writer error: length mismatch")
 		}
-		if err := lz4w.Close(); err != nil {
-			return nil, fmt.Errorf("failed to close lz4 writer: %w", err)
+		if block.Len() < w.opts.blockSize && i < len(records)-1 {
+			continue
 		}
 
-		blockSize := w.lz4Buf.Len()
-		if err := binary.Write(w.dest, binary.LittleEndian, uint32(blockSize)); err != nil {
-			return nil, fmt.Errorf("failed to write block size: %w", err)
-		}
-		n, err := io.Copy(w.dest, w.lz4Buf)
+		n, err := w.writeBlock(block.Bytes())
 		if err != nil {
-			return nil, fmt.Errorf("failed to write compressed data: %w", err)
-		}
-		if n != int64(blockSize) {
-			return nil, fmt.Errorf("write compress data err: data length err %d,%d", n, int64(blockSize))
+			return nil, err
 		}
-
 		sparseIndex = append(sparseIndex, &SparseIndex{
-			MinKey:     res[0].Key,
-			MaxKey:     res[len(res)-1].Key,
-			BlockIndex: uint32(i),
+			MinKey:     records[start].Key,
+			MaxKey:     re.Key,
+			BlockIndex: uint32(len(sparseIndex)),
 			DataOffset: uint32(offset),
 			FileName:   w.fileName,
 		})
-		offset += blockSize + 4
+		offset += n
+		start = i + 1
+		block.Reset()
 	}
 
+	// 统计信息 超出范围时取最大值
 	metaInfo := SSTableMetaInfo{
 		DataOffset:    0,
 		DataLength:    uint64(offset),
 		IndexOffset:   uint64(offset),
-		BlockKeyNum:   uint16(len(records)),
-		TableBlockNum: uint16(w.opts.tableNum),
-		Version:       0,
+		TableBlockNum: uint16(min(len(sparseIndex), math.MaxUint16)),
+		Version:       sstFormatVersion,
+	}
+	if len(sparseIndex) > 0 {
+		perBlock := (len(records) + len(sparseIndex) - 1) / len(sparseIndex)
+		metaInfo.BlockKeyNum = uint16(min(perBlock, math.MaxUint16))
+	}
+	if len(records) > 0 {
+		metaInfo.MinSeq = records[0].Seq
+	}
+	for _, re := range records {
+		metaInfo.MinSeq = min(metaInfo.MinSeq, re.Seq)
+		metaInfo.MaxSeq = max(metaInfo.MaxSeq, re.Seq)
 	}
 	for i := range sparseIndex {
 		n, body := sparseIndex[i].Bytes()
@@ -121,6 +117,27 @@ func (w *SSTWriter) SyncMemTable(mem *MemTable) ([]*SparseIndex, error) {
 		metaInfo.IndexLength += uint64(n) + 4
 	}
 
+	// 过滤器紧跟在稀疏索引之后 查询时先判断key是否可能存在
+	if policy := w.opts.filterPolicy; policy != nil {
+		var keys [][]byte
+		for i, re := range records {
+			// 同一个key的多个版本只添加一次
+			if i == 0 || re.Key != records[i-1].Key {
+				keys = append(keys, []byte(re.Key))
+			}
+		}
+		filter, err := policy.CreateFilter(keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create filter: %w", err)
+		}
+		data := encodeFilterBlock(policy.Name(), filter)
+		if _, err := w.dest.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to write filter: %w", err)
+		}
+		metaInfo.FilterOffset = metaInfo.IndexOffset + metaInfo.IndexLength
+		metaInfo.FilterLength = uint64(len(data))
+	}
+
 	if _, err := w.dest.Write(metaInfo.Bytes()); err != nil {
 		return nil, fmt.Errorf("failed to write meta info: %w", err)
 	} else {
@@ -137,120 +154,180 @@ func (w *SSTWriter) SyncMemTable(mem *MemTable) ([]*SparseIndex, error) {
 	return sparseIndex, nil
 }
 
-// divRecords 对于records进行划分 步长为nums
-func divRecords(records []*Record, nums int) [][]*Record {
-	var result [][]*Record
-	for i := 0; i < len(records); i += nums {
-		end := i + nums
-		if end > len(records) {
-			end = len(records)
-		}
-		result = append(result, records[i:end])
+// 压缩并写入一个block 格式为[len u32][lz4 data] 返回写入的字节数
+func (w *SSTWriter) writeBlock(data []byte) (int, error) {
+	w.lz4Buf.Reset()
+	lz4w := lz4.NewWriter(w.lz4Buf)
+	if _, err := lz4w.Write(data); err != nil {
+		return 0, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := lz4w.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close lz4 writer: %w", err)
+	}
+
+	blockSize := w.lz4Buf.Len()
+	if err := binary.Write(w.dest, binary.LittleEndian, uint32(blockSize)); err != nil {
+		return 0, fmt.Errorf("failed to write block size: %w", err)
+	}
+	n, err := io.Copy(w.dest, w.lz4Buf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write compressed data: %w", err)
 	}
-	return result
+	if n != int64(blockSize) {
+		return 0, fmt.Errorf("write compress data err: data length err %d,%d", n, int64(blockSize))
+	}
+	return blockSize + 4, nil
 }
 
+// SSTReader 按位置读取sst文件 不修改文件偏移 多个协程可以同时读取
+// 每次读取使用独立的缓冲区 mmap时直接从映射中解析
 type SSTReader struct {
-	dest     *os.File      // sstable 对应的磁盘文件
-	lz4Buf   *bytes.Buffer // 缓冲区
-	dataBuf  *bytes.Buffer
+	dest     *os.File    // sstable 对应的磁盘文件
+	src      io.ReaderAt // 按位置读取
+	size     int64       // 文件大小
+	mapped   []byte      // mmap映射的文件内容 为nil时按位置读取
 	fileName string
 }
 
+// Close 解除映射并关闭文件 之后不能再访问readAt返回的数据
 func (r *SSTReader) Close() {
+	if r.mapped != nil {
+		_ = munmapFile(r.mapped)
+		r.mapped = nil
+	}
 	_ = r.dest.Close()
 }
 func NewSSTReader(fileName string) (*SSTReader, error) {
+	return newSSTReader(fileName, false)
+}
+
+// mmap为true时映射整个文件 平台不支持时按位置读取
+func newSSTReader(fileName string, mmap bool) (*SSTReader, error) {
 	fp, err := os.OpenFile(fileName, os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
-	return &SSTReader{
+	info, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	r := &SSTReader{
 		dest:     fp,
-		lz4Buf:   bytes.NewBuffer(nil),
-		dataBuf:  bytes.NewBuffer(nil),
+		src:      fp,
+		size:     info.Size(),
 		fileName: fileName,
-	}, nil
+	}
+	if mmap && r.size > 0 {
+		if r.mapped, err = mmapFile(fp, r.size); err != nil {
+			_ = fp.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// 读取[offset, offset+n)的数据 数据不足时返回错误
+// mmap时返回映射中的数据 只能在reader关闭之前使用 不能保留
+func (r *SSTReader) readAt(offset int64, n int) ([]byte, error) {
+	if offset < 0 || offset+int64(n) > r.size {
+		return nil, fmt.Errorf("read %s out of range: offset=%d length=%d size=%d", r.fileName, offset, n, r.size)
+	}
+	if r.mapped != nil {
+		return r.mapped[offset : offset+int64(n)], nil
+	}
+	data := make([]byte, n)
+	if _, err := r.src.ReadAt(data, offset); err != nil && !(err == io.EOF && offset+int64(n) == r.size) {
+		return nil, err
+	}
+	return data, nil
 }
+
 func (r *SSTReader) Restore(mem *MemTable) error {
-	reader := lz4.NewReader(r.dest)
-	if _, err := r.dataBuf.ReadFrom(reader); err != nil {
+	reader := lz4.NewReader(io.NewSectionReader(r.src, 0, r.size))
+	dataBuf := bytes.NewBuffer(nil)
+	if _, err := dataBuf.ReadFrom(reader); err != nil {
 		return err
 	}
 	// 会得到数据 这部分的数据 需要恢复到memtable之中
-	if err := mem.Restore(r.dataBuf.Bytes()); err != nil {
+	if err := mem.Restore(dataBuf.Bytes()); err != nil {
 		return err
 	}
 	return nil
 }
+
+// ReadMetaInfo 读取文件末尾的元信息
+func (r *SSTReader) ReadMetaInfo() (*SSTableMetaInfo, error) {
+	data, err := r.readAt(r.size-int64(SizeOfMetaInfo), int(SizeOfMetaInfo))
+	if err != nil {
+		return nil, fmt.Errorf("read metainfo error: %w", err)
+	}
+	metaInfo := new(SSTableMetaInfo)
+	metaInfo.Restore(data)
+	if metaInfo.Version != sstFormatVersion {
+		return nil, fmt.Errorf("%w: %s version %d", ErrSSTVersion, r.fileName, metaInfo.Version)
+	}
+	return metaInfo, nil
+}
 func (r *SSTReader) ReadBlock() ([]*SparseIndex, error) {
 	var ans []*SparseIndex
-	r.dest.Seek(-int64(SizeOfMetaInfo), io.SeekEnd)
-	data := make([]byte, SizeOfMetaInfo)
-	nn, err := r.dest.Read(data)
-	if err != nil && err != io.EOF {
+	metaInfo, err := r.ReadMetaInfo()
+	if err != nil {
 		return nil, err
 	}
-	if nn != int(SizeOfMetaInfo) {
-		return nil, fmt.Errorf("read metainfo length error: %d", nn)
-	}
-
-	metaInfo := new(SSTableMetaInfo)
-	metaInfo.Restore(data)
-	//fmt.Printf("metainfo length=%d, %+v\n", nn, metaInfo)
 
 	// restore sparse index
-	r.dest.Seek(int64(metaInfo.IndexOffset), io.SeekStart)
-	var n uint32
-	var offset uint64
-	for offset < metaInfo.IndexLength {
-		if err = binary.Read(r.dest, binary.LittleEndian, &n); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
+	data, err := r.readAt(int64(metaInfo.IndexOffset), int(metaInfo.IndexLength))
+	if err != nil {
+		return nil, err
+	}
+	for len(data) >= 4 {
+		n := binary.LittleEndian.Uint32(data)
 		if n == 0 {
 			break
 		}
-		if cap(data) < int(n) {
-			data = make([]byte, n)
-		} else {
-			data = data[:n]
-		}
-		if _, err = r.dest.Read(data); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+		if uint64(len(data)-4) < uint64(n) {
+			return nil, fmt.Errorf("sparse index length error: %d", n)
 		}
 		sparseIndex := &SparseIndex{FileName: r.fileName}
-		sparseIndex.Restore(data)
+		sparseIndex.Restore(data[4 : 4+n])
 		ans = append(ans, sparseIndex)
-		offset += 4 + uint64(n)
+		data = data[4+n:]
 	}
 
 	return ans, nil
 }
 
-// 读取对应的block进行数据查找
-func (r *SSTReader) readSSTBlock(blockOffset uint32) (*MemTable, error) {
-	var n uint32
-
-	if _, err := r.dest.Seek(int64(blockOffset), io.SeekStart); err != nil {
+// ReadFilter 按照policy解析文件中的过滤器 没有过滤器或者类型不一致时返回nil
+func (r *SSTReader) ReadFilter(policy FilterPolicy) (Filter, error) {
+	metaInfo, err := r.ReadMetaInfo()
+	if err != nil {
 		return nil, err
 	}
-
-	if err := binary.Read(r.dest, binary.LittleEndian, &n); err != nil {
+	if metaInfo.FilterLength == 0 {
+		return nil, nil
+	}
+	data, err := r.readAt(int64(metaInfo.FilterOffset), int(metaInfo.FilterLength))
+	if err != nil {
 		return nil, err
 	}
-	data := make([]byte, n)
-	count, err := io.ReadFull(r.dest, data)
+	// 过滤器在节点的整个生命周期中使用 不能引用映射的内存
+	if r.mapped != nil {
+		data = append([]byte(nil), data...)
+	}
+	return decodeFilterBlock(policy, data)
+}
+
+// 读取对应的block进行数据查找
+func (r *SSTReader) readSSTBlock(blockOffset uint32) (*MemTable, error) {
+	header, err := r.readAt(int64(blockOffset), 4)
 	if err != nil {
 		return nil, err
 	}
-	if count != int(n) {
-		return nil, fmt.Errorf("read metainfo length error: %d", count)
+	n := binary.LittleEndian.Uint32(header)
+	data, err := r.readAt(int64(blockOffset)+4, int(n))
+	if err != nil {
+		return nil, err
 	}
 
 	lz4r := lz4.NewReader(bytes.NewReader(data))
@@ -262,6 +339,7 @@ func (r *SSTReader) readSSTBlock(blockOffset uint32) (*MemTable, error) {
 	mem := NewMemTable()
 	var (
 		rType RecordType
+		seq   uint64
 	)
 	for {
 
@@ -271,11 +349,14 @@ func (r *SSTReader) readSSTBlock(blockOffset uint32) (*MemTable, error) {
 			}
 			return nil, err
 		}
+		if err := binary.Read(buf, binary.LittleEndian, &seq); err != nil {
+			return nil, err
+		}
 		if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
 			return nil, err
 		}
 		Key := string(buf.Next(int(n)))
-		record := &Record{Key: Key, RType: rType}
+		record := &Record{Key: Key, RType: rType, Seq: seq}
 		if rType == RecordUpdate {
 			if err := binary.Read(buf, binary.LittleEndian, &n); err != nil {
 				return nil, err
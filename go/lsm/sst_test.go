@@ -3,6 +3,8 @@ package lsm
 import (
 	"fmt"
 	"github.com/xia-Sang/lsm_go/util"
+	"path"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -155,3 +157,150 @@ func TestSSTReader_Restore2(t *testing.T) {
 	}
 	t.Log(sparseIndex)
 }
+
+func TestSSTReader_Concurrent(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	m := NewMemTable()
+	for i := range 200 {
+		m.Set(&Record{Key: util.GenerateKeyString(i), Value: util.GenerateValueString(12), RType: RecordUpdate, Seq: uint64(i + 1)})
+	}
+	fileName := path.Join(opts.dirPath, "1.sst")
+	w, err := NewSSTWriter(fileName, opts)
+	assert.Nil(t, err)
+	_, err = w.SyncMemTable(m)
+	assert.Nil(t, err)
+
+	r, err := NewSSTReader(fileName)
+	assert.Nil(t, err)
+	defer r.Close()
+	sparseIndex, err := r.ReadBlock()
+	assert.Nil(t, err)
+	assert.True(t, len(sparseIndex) > 1)
+
+	// 多个协程同时读取不同的block 读到的数据不会错乱
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				index := sparseIndex[(g+i)%len(sparseIndex)]
+				block, err := r.readSSTBlock(index.DataOffset)
+				assert.Nil(t, err)
+				records := block.GetRecords()
+				assert.Equal(t, index.MinKey, records[0].Key)
+				assert.Equal(t, index.MaxKey, records[len(records)-1].Key)
+				_, err = r.ReadFilter(opts.filterPolicy)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 超出文件范围的读取返回错误
+	_, err = r.readSSTBlock(uint32(r.size))
+	assert.NotNil(t, err)
+}
+
+func TestLsm_MmapReads(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxLevelNum(2), WithMmapReads(true))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 100 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	node := db.nodes[0][0]
+	h, err := opts.tableCache.get(node.fileName)
+	assert.Nil(t, err)
+	assert.NotNil(t, h.reader.mapped)
+	opts.tableCache.release(h)
+
+	// 合并之后旧的文件被删除 映射随之解除
+	for i := 100; i < 300; i++ {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	db.waitForCompact()
+	assert.NotContains(t, db.nodes[0], node)
+	assert.Nil(t, h.reader.mapped)
+	for i := range 300 {
+		_, err := db.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+	records, err := db.Scan("", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(records))
+}
+
+func TestSSTWriter_BlockSize(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithBlockSize(1024))
+	assert.Nil(t, err)
+	m := NewMemTable()
+	for i := range 100 {
+		m.Set(&Record{Key: util.GenerateKeyString(i), Value: util.GenerateValueString(12), RType: RecordUpdate, Seq: uint64(i + 1)})
+	}
+	// 较大的记录写入之后block超过blockSize
+	m.Set(&Record{Key: util.GenerateKeyString(100), Value: util.GenerateValueString(4096), RType: RecordUpdate, Seq: 101})
+	fileName := path.Join(opts.dirPath, "1.sst")
+	w, err := NewSSTWriter(fileName, opts)
+	assert.Nil(t, err)
+	sparseIndex, err := w.SyncMemTable(m)
+	assert.Nil(t, err)
+
+	r, err := NewSSTReader(fileName)
+	assert.Nil(t, err)
+	defer r.Close()
+	metaInfo, err := r.ReadMetaInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, len(sparseIndex), int(metaInfo.TableBlockNum))
+	assert.Equal(t, (101+len(sparseIndex)-1)/len(sparseIndex), int(metaInfo.BlockKeyNum))
+
+	total := 0
+	for i, index := range sparseIndex {
+		block, err := r.readSSTBlock(index.DataOffset)
+		assert.Nil(t, err)
+		size := 0
+		records := block.GetRecords()
+		for _, re := range records {
+			n, _ := re.Bytes()
+			size += n
+		}
+		// 除了最后一个block 每个block去掉最后一条记录之后都小于blockSize
+		last, _ := records[len(records)-1].Bytes()
+		assert.True(t, size-last < 1024)
+		if i < len(sparseIndex)-1 {
+			assert.True(t, size >= 1024)
+		}
+		total += len(records)
+	}
+	assert.Equal(t, 101, total)
+	assert.Equal(t, util.GenerateKeyString(100), sparseIndex[len(sparseIndex)-1].MaxKey)
+}
+
+func TestSSTReader_Version(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	m := NewMemTable()
+	m.Set(&Record{Key: "a", Value: "1", RType: RecordUpdate, Seq: 1})
+	fileName := path.Join(opts.dirPath, "1.sst")
+	w, err := NewSSTWriter(fileName, opts)
+	assert.Nil(t, err)
+	_, err = w.SyncMemTable(m)
+	assert.Nil(t, err)
+	r, err := NewSSTReader(fileName)
+	assert.Nil(t, err)
+	defer r.Close()
+	metaInfo, err := r.ReadMetaInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, sstFormatVersion, metaInfo.Version)
+
+	// 旧版本写入的文件没有序列号 不能按照新的格式解析
+	r, err = NewSSTReader("testdata/legacy/00_000000.sst")
+	assert.Nil(t, err)
+	defer r.Close()
+	_, err = r.ReadMetaInfo()
+	assert.ErrorIs(t, err, ErrSSTVersion)
+}
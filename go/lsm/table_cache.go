@@ -0,0 +1,123 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+// tableHandle 打开的sst文件 refs为正在读取的数量
+type tableHandle struct {
+	fileName string
+	reader   *SSTReader
+	refs     int
+	elem     *list.Element // 从cache中移除之后为nil 最后一次释放时关闭文件
+}
+
+// tableCache 限制同时打开的sst文件数量 按需打开 超出数量时关闭最久没有使用的文件
+// 正在读取的文件不会被关闭 数量可能暂时超出限制
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	mmap     bool // 通过mmap读取文件
+	items    map[string]*tableHandle
+	lru      *list.List // 队首为最近使用
+}
+
+func newTableCache(capacity int, mmap bool) *tableCache {
+	return &tableCache{
+		capacity: capacity,
+		mmap:     mmap,
+		items:    make(map[string]*tableHandle),
+		lru:      list.New(),
+	}
+}
+
+// get 获取打开的reader 使用完之后需要调用release
+func (c *tableCache) get(fileName string) (*tableHandle, error) {
+	c.mu.Lock()
+	if h, ok := c.items[fileName]; ok {
+		h.refs++
+		c.lru.MoveToFront(h.elem)
+		c.mu.Unlock()
+		return h, nil
+	}
+	c.mu.Unlock()
+
+	// 打开文件时不持有锁
+	reader, err := newSSTReader(fileName, c.mmap)
+	if err != nil {
+		return nil, err
+	}
+	return c.insert(fileName, reader), nil
+}
+
+// add 将已经打开的reader交给cache管理 不持有引用
+func (c *tableCache) add(fileName string, reader *SSTReader) {
+	c.release(c.insert(fileName, reader))
+}
+
+func (c *tableCache) insert(fileName string, reader *SSTReader) *tableHandle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 并发打开了同一个文件 使用先放入的reader
+	if h, ok := c.items[fileName]; ok {
+		reader.Close()
+		h.refs++
+		c.lru.MoveToFront(h.elem)
+		return h
+	}
+	h := &tableHandle{fileName: fileName, reader: reader, refs: 1}
+	h.elem = c.lru.PushFront(h)
+	c.items[fileName] = h
+	c.evictLocked()
+	return h
+}
+
+func (c *tableCache) release(h *tableHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.refs--
+	if h.elem == nil {
+		if h.refs == 0 {
+			h.reader.Close()
+		}
+		return
+	}
+	c.evictLocked()
+}
+
+// evict 文件被删除或者lsm关闭时调用 正在读取的文件在释放之后关闭
+func (c *tableCache) evict(fileName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.items[fileName]; ok {
+		c.removeLocked(h)
+	}
+}
+
+// 从最久没有使用的文件开始关闭 跳过正在读取的文件
+func (c *tableCache) evictLocked() {
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.capacity; {
+		prev := e.Prev()
+		if h := e.Value.(*tableHandle); h.refs == 0 {
+			c.removeLocked(h)
+		}
+		e = prev
+	}
+}
+
+func (c *tableCache) removeLocked(h *tableHandle) {
+	delete(c.items, h.fileName)
+	c.lru.Remove(h.elem)
+	h.elem = nil
+	if h.refs == 0 {
+		h.reader.Close()
+	}
+}
+
+// 当前打开的文件数量
+func (c *tableCache) openFiles() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestTableCache_Evict(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithMaxSSTSize(50), WithMaxLevelNum(100), WithMaxOpenFiles(2), WithBlockCacheSize(-1))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 500 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	db.waitForCompact()
+	var nodes []*Node
+	for _, level := range db.nodes {
+		nodes = append(nodes, level...)
+	}
+	assert.True(t, len(nodes) > 2)
+	assert.True(t, opts.tableCache.openFiles() <= 2)
+
+	for i := range 500 {
+		_, err := db.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, opts.tableCache.openFiles() <= 2)
+
+	// 正在读取的文件被淘汰之后 释放时才关闭
+	tc := newTableCache(1, false)
+	a, err := tc.get(nodes[0].fileName)
+	assert.Nil(t, err)
+	b, err := tc.get(nodes[1].fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tc.openFiles())
+	tc.release(a)
+	assert.Equal(t, 1, tc.openFiles())
+	tc.evict(b.fileName)
+	_, err = b.reader.ReadMetaInfo()
+	assert.Nil(t, err)
+	tc.release(b)
+	_, err = b.reader.ReadMetaInfo()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, tc.openFiles())
+}
+
+func TestTableCache_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithMaxSSTSize(100), WithMaxLevelNum(2))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+	for i := range 200 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	db.waitForCompact()
+
+	roOpts, err := NewOptions(dir, WithReadOnly(true), WithMaxOpenFiles(1), WithBlockCacheSize(-1))
+	assert.Nil(t, err)
+	ro, err := DefaultLsmTree(roOpts)
+	assert.Nil(t, err)
+	defer ro.Close()
+
+	// 写入实例合并之后删除旧的文件 只读实例仍然可以读取
+	for i := range 200 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	assert.Nil(t, db.Flush())
+	db.waitForCompact()
+	for i := range 200 {
+		_, err := ro.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+}
@@ -1,42 +1,184 @@
 package lsm
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 )
 
+// ErrWalCorrupted wal中间出现校验失败的记录 继续恢复会丢失之后已经提交的数据
+var ErrWalCorrupted = errors.New("wal corrupted")
+
+// wal文件按照32KiB划分为block 每条记录切分为多个片段 片段不会跨越block
+// 片段格式为 [crc32c u32][len u16][type u8][data] crc覆盖type和data
+// 某个片段损坏时 从下一个block开始仍然可以继续读取
+const (
+	walBlockSize  = 32 * 1024
+	walHeaderSize = 7
+)
+
+// 片段类型 一条记录可以是一个FULL 或者FIRST MIDDLE... LAST
+const (
+	walZeroType   uint8 = 0 // 预分配的空间
+	walFullType   uint8 = 1
+	walFirstType  uint8 = 2
+	walMiddleType uint8 = 3
+	walLastType   uint8 = 4
+)
+
+// WalRecoveryMode 恢复wal时遇到损坏记录的处理方式
+type WalRecoveryMode int
+
+const (
+	// WalRecoveryTolerateCorruptedTail 只容忍末尾写了一半的记录 中间的记录损坏时打开失败
+	WalRecoveryTolerateCorruptedTail WalRecoveryMode = iota
+	// WalRecoveryPointInTime 恢复到第一条损坏的记录之前 之后的记录以及更新的wal全部丢弃
+	WalRecoveryPointInTime
+	// WalRecoverySkipAnyCorruptedRecords 跳过所有损坏的记录 继续恢复之后的记录
+	WalRecoverySkipAnyCorruptedRecords
+	// WalRecoveryAbsoluteConsistency 任何损坏 包括末尾写了一半的记录 都打开失败
+	WalRecoveryAbsoluteConsistency
+)
+
+// WalDropReport 恢复wal时丢弃的数据
+type WalDropReport struct {
+	FileName string
+	Records  int   // 丢弃的wal记录数量 每条记录是一个batch
+	Bytes    int64 // 丢弃的字节数
+}
+
 type WalWriter struct {
-	fileName string
-	dest     *os.File
+	fileName    string
+	dest        *os.File
+	buf         *bufio.Writer // 写入文件之前的缓冲区
+	blockOffset int           // 当前block中已经写入的字节数
 }
 
 func NewWalWriter(fileName string) (*WalWriter, error) {
-	fp, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	fp, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
-	return &WalWriter{fileName: fileName, dest: fp}, nil
+	info, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	return &WalWriter{
+		fileName:    fileName,
+		dest:        fp,
+		buf:         bufio.NewWriterSize(fp, walBlockSize),
+		blockOffset: int(info.Size() % walBlockSize),
+	}, nil
 }
 func (w *WalWriter) Write(record *Record) (int, error) {
-	n, body := record.Bytes()
-	err := binary.Write(w.dest, binary.LittleEndian, uint32(n))
+	return w.WriteBatch(&WriteBatch{records: []*Record{record}})
+}
+
+// WriteBatch 整个batch作为一条记录写入文件
+// 恢复时通过校验和发现写了一半或者损坏的记录
+func (w *WalWriter) WriteBatch(batch *WriteBatch) (int, error) {
+	n, err := w.addBatch(batch)
 	if err != nil {
 		return 0, err
 	}
-	if _, err := w.dest.Write(body); err != nil {
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// 只写入缓冲区 由调用方决定何时写入文件
+func (w *WalWriter) addBatch(batch *WriteBatch) (int, error) {
+	n, body := batch.Bytes()
+	if _, err := w.buf.Write(w.encode(body)); err != nil {
 		return 0, err
 	}
 	return n, nil
 }
+
+// Flush 将缓冲区写入文件
+func (w *WalWriter) Flush() error {
+	return w.buf.Flush()
+}
+
+// Sync 写入文件并刷盘
+func (w *WalWriter) Sync() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.dest.Sync()
+}
+
+// 将记录切分为片段 block剩余的空间放不下头部时填充0
+func (w *WalWriter) encode(data []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	var header [walHeaderSize]byte
+	begin := true
+	for {
+		if left := walBlockSize - w.blockOffset; left < walHeaderSize {
+			buf.Write(make([]byte, left))
+			w.blockOffset = 0
+		}
+		n := min(len(data), walBlockSize-w.blockOffset-walHeaderSize)
+		end := n == len(data)
+		typ := walMiddleType
+		switch {
+		case begin && end:
+			typ = walFullType
+		case begin:
+			typ = walFirstType
+		case end:
+			typ = walLastType
+		}
+		binary.LittleEndian.PutUint32(header[:], fragmentChecksum(typ, data[:n]))
+		binary.LittleEndian.PutUint16(header[4:], uint16(n))
+		header[6] = typ
+		buf.Write(header[:])
+		buf.Write(data[:n])
+		w.blockOffset += walHeaderSize + n
+		data, begin = data[n:], false
+		if end {
+			return buf.Bytes()
+		}
+	}
+}
+
+func fragmentChecksum(typ uint8, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum([]byte{typ}, crcTable), crcTable, data)
+}
+
 func (w *WalWriter) Close() {
+	_ = w.buf.Flush()
 	_ = w.dest.Close()
 }
 
-// WalReader WalReader结构体
+// WalReader 按顺序读取wal中的记录
+//
+//	for r.Next() {
+//		batch := r.Batch()
+//	}
+//	if err := r.Err(); err != nil {...}
 type WalReader struct {
 	fileName string
 	src      *os.File
+	mode     WalRecoveryMode
+
+	block      []byte // 当前block
+	blockStart int64  // 当前block在文件中的位置
+	pos        int    // 当前block中读取的位置
+	eof        bool   // 当前block是文件的最后一个block
+
+	batch   *WriteBatch
+	err     error
+	offset  int64         // 最后一条保留的记录的结束位置 之后的内容都被丢弃
+	dropped WalDropReport // 恢复时丢弃的数据
+	cut     bool          // point in time模式下遇到损坏 之后的数据全部丢弃
 }
 
 func (w *WalReader) Close() {
@@ -51,57 +193,219 @@ func NewWalReader(fileName string) (*WalReader, error) {
 	return &WalReader{
 		fileName: fileName,
 		src:      fp,
+		block:    make([]byte, 0, walBlockSize),
+		dropped:  WalDropReport{FileName: fileName},
 	}, nil
 }
 
-func (w *WalReader) Restore() {
+// Next 读取下一条记录 返回false时读取结束 通过Err判断是否出错
+func (w *WalReader) Next() bool {
+	if w.err != nil {
+		return false
+	}
+	for {
+		data, size, err := w.readRecord()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			w.err = err
+			return false
+		}
+		batch := &WriteBatch{}
+		if w.cut {
+			err = w.drop(size, 1, false)
+		} else if err = batch.Restore(data); err != nil {
+			err = w.drop(size, 1, false)
+		} else {
+			w.batch = batch
+			w.offset = w.blockStart + int64(w.pos)
+			return true
+		}
+		if err != nil {
+			w.err = err
+			return false
+		}
+	}
+}
 
+// Batch 当前记录
+func (w *WalReader) Batch() *WriteBatch {
+	return w.batch
+}
+
+// Err 读取过程中的错误 记录损坏并且恢复模式不允许丢弃时返回ErrWalCorrupted
+func (w *WalReader) Err() error {
+	return w.err
 }
 
 // RestoreToMemTable 可以将数据恢复到memtable之中
+// 末尾写了一半的记录直接丢弃 中间的记录损坏时返回ErrWalCorrupted
 func (w *WalReader) RestoreToMemTable(mem *MemTable) error {
-	records, err := readWal(w.src)
-	if err != nil {
-		return err
+	return w.recover(mem, WalRecoveryTolerateCorruptedTail, false)
+}
+
+// 按照mode恢复数据到memtable dropAll为true时整个文件都被丢弃 只统计丢弃的数据
+func (w *WalReader) recover(mem *MemTable, mode WalRecoveryMode, dropAll bool) error {
+	w.mode, w.cut = mode, dropAll
+	for w.Next() {
+		for _, v := range w.batch.records {
+			mem.Set(v)
+		}
 	}
-	for _, v := range records {
-		mem.Set(v)
+	return w.Err()
+}
+
+// 丢弃数据 tail表示写入时崩溃造成的不完整的末尾
+// 按照恢复模式决定是否返回错误 point in time模式下之后的数据都不能再恢复
+func (w *WalReader) drop(size int64, records int, tail bool) error {
+	if !w.cut {
+		if w.mode == WalRecoveryAbsoluteConsistency || w.mode == WalRecoveryTolerateCorruptedTail && !tail {
+			return fmt.Errorf("%w: %s bad record in block at offset %d", ErrWalCorrupted, w.fileName, w.blockStart)
+		}
+		w.cut = w.mode == WalRecoveryPointInTime
 	}
+	w.dropped.Records += records
+	w.dropped.Bytes += size
 	return nil
 }
 
-// 读取wal信息返回[]*record即可
-func readWal(f io.ReadSeeker) ([]*Record, error) {
-	var n uint32
-	var err error
-	var data []byte
-	var records []*Record
+// 由片段组装出一条完整的记录 返回数据以及占用的字节数
+func (w *WalReader) readRecord() ([]byte, int64, error) {
+	var (
+		record     []byte
+		size       int64
+		inFragment bool
+	)
+	// 丢弃已经读取的片段 重新开始
+	// records为0表示这条记录已经在损坏的片段中按照恢复模式处理过
+	reset := func(records int, tail bool) error {
+		if !inFragment {
+			return nil
+		}
+		err := w.drop(size, records, tail)
+		record, size, inFragment = nil, 0, false
+		return err
+	}
 	for {
-		if err = binary.Read(f, binary.LittleEndian, &n); err != nil {
-			if err == io.EOF {
-				break
+		typ, data, err := w.readFragment()
+		if err == io.EOF {
+			// 文件末尾只有记录的前半部分
+			if err := reset(1, true); err != nil {
+				return nil, 0, err
 			}
-			return nil, err
+			return nil, 0, io.EOF
 		}
-		if n == 0 {
-			break
+		if err == errBadFragment {
+			if err := reset(0, true); err != nil {
+				return nil, 0, err
+			}
+			continue
 		}
-		if cap(data) < int(n) {
-			data = make([]byte, n)
-		} else {
-			data = data[:n]
+		if err != nil {
+			return nil, 0, err
 		}
+		switch typ {
+		case walFullType, walFirstType:
+			if err := reset(1, false); err != nil {
+				return nil, 0, err
+			}
+			record, size, inFragment = append(record, data...), walHeaderSize+int64(len(data)), true
+			if typ == walFullType {
+				return record, size, nil
+			}
+		case walMiddleType, walLastType:
+			if !inFragment {
+				// 前面的片段已经丢失
+				if err := w.drop(walHeaderSize+int64(len(data)), 1, false); err != nil {
+					return nil, 0, err
+				}
+				continue
+			}
+			record, size = append(record, data...), size+walHeaderSize+int64(len(data))
+			if typ == walLastType {
+				return record, size, nil
+			}
+		default:
+			if err := reset(1, false); err != nil {
+				return nil, 0, err
+			}
+			if err := w.drop(walHeaderSize+int64(len(data)), 1, false); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+}
 
-		if _, err = f.Read(data); err != nil {
-			if err == io.EOF {
-				break
+// errBadFragment 片段损坏 已经按照恢复模式处理 跳过即可
+var errBadFragment = errors.New("bad wal fragment")
+
+// 读取下一个片段 文件结束时返回io.EOF
+// 长度或者校验和错误时 该block剩余的数据都不可信 直接跳到下一个block
+func (w *WalReader) readFragment() (uint8, []byte, error) {
+	for {
+		if w.pos+walHeaderSize > len(w.block) {
+			left := int64(len(w.block) - w.pos)
+			if w.eof {
+				// 文件末尾不完整的头部
+				if left > 0 {
+					w.pos = len(w.block)
+					if err := w.drop(left, 1, true); err != nil {
+						return 0, nil, err
+					}
+				}
+				return 0, nil, io.EOF
 			}
-			return nil, err
+			// 不足一个头部的空间是block末尾的填充
+			if err := w.readBlock(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		header := w.block[w.pos : w.pos+walHeaderSize]
+		checksum := binary.LittleEndian.Uint32(header)
+		n := int(binary.LittleEndian.Uint16(header[4:]))
+		typ := header[6]
+		if typ == walZeroType && n == 0 {
+			// 预分配的空间 跳过这个block剩余的部分
+			w.pos = len(w.block)
+			continue
+		}
+		end := w.pos + walHeaderSize + n
+		if end > len(w.block) {
+			left := int64(len(w.block) - w.pos)
+			w.pos = len(w.block)
+			// 最后一个block中超出文件末尾的片段是写了一半的记录
+			if err := w.drop(left, 1, w.eof); err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, errBadFragment
+		}
+		data := w.block[w.pos+walHeaderSize : end]
+		if fragmentChecksum(typ, data) != checksum {
+			left := int64(len(w.block) - w.pos)
+			tail := w.eof && end == len(w.block)
+			w.pos = len(w.block)
+			if err := w.drop(left, 1, tail); err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, errBadFragment
 		}
-		record := &Record{}
-		record.Restore(data)
-		records = append(records, record)
+		w.pos = end
+		return typ, data, nil
 	}
+}
 
-	return records, nil
+// 读取下一个block 文件最后一个block可能不完整
+func (w *WalReader) readBlock() error {
+	w.blockStart += int64(len(w.block))
+	w.block = w.block[:walBlockSize]
+	n, err := io.ReadFull(w.src, w.block)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		w.eof = true
+	} else if err != nil {
+		return err
+	}
+	w.block, w.pos = w.block[:n], 0
+	return nil
 }
@@ -1,7 +1,11 @@
 package lsm
 
 import (
+	"fmt"
 	"github.com/xia-Sang/lsm_go/util"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,3 +41,276 @@ func TestWal_Writer(t *testing.T) {
 	}
 	nb.Show()
 }
+
+func TestWal_WriteBatch(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "1.wal")
+	walWriter, err := NewWalWriter(fileName)
+	assert.Nil(t, err)
+	batch := NewWriteBatch()
+	for i := range 10 {
+		batch.Put(util.GenerateKeyString(i), util.GenerateValueString(12))
+	}
+	batch.Delete(util.GenerateKeyString(3))
+	_, err = walWriter.WriteBatch(batch)
+	assert.Nil(t, err)
+
+	batch.Clear()
+	for i := 10; i < 20; i++ {
+		batch.Put(util.GenerateKeyString(i), util.GenerateValueString(12))
+	}
+	_, err = walWriter.WriteBatch(batch)
+	assert.Nil(t, err)
+	walWriter.Close()
+
+	// 模拟第二个batch只写入了一半
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(fileName, info.Size()-20))
+
+	walReader, err := NewWalReader(fileName)
+	assert.Nil(t, err)
+	defer walReader.Close()
+	nb := NewMemTable()
+	assert.Nil(t, walReader.RestoreToMemTable(nb))
+	assert.Equal(t, RecordDelete, nb.Query(util.GenerateKeyString(3)).RType)
+	assert.NotNil(t, nb.Query(util.GenerateKeyString(9)))
+	for i := 10; i < 20; i++ {
+		assert.Nil(t, nb.Query(util.GenerateKeyString(i)))
+	}
+}
+
+func TestWal_Checksum(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "1.wal")
+	walWriter, err := NewWalWriter(fileName)
+	assert.Nil(t, err)
+	for i := range 3 {
+		batch := NewWriteBatch()
+		batch.Put(util.GenerateKeyString(i), util.GenerateValueString(12))
+		_, err = walWriter.WriteBatch(batch)
+		assert.Nil(t, err)
+	}
+	walWriter.Close()
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	size := len(data) / 3
+
+	restore := func(data []byte) (*MemTable, error) {
+		assert.Nil(t, os.WriteFile(fileName, data, os.ModePerm))
+		walReader, err := NewWalReader(fileName)
+		assert.Nil(t, err)
+		defer walReader.Close()
+		nb := NewMemTable()
+		return nb, walReader.RestoreToMemTable(nb)
+	}
+
+	// 最后一条记录损坏 视为写了一半 丢弃
+	bad := append([]byte(nil), data...)
+	bad[len(bad)-1] ^= 0xff
+	nb, err := restore(bad)
+	assert.Nil(t, err)
+	assert.NotNil(t, nb.Query(util.GenerateKeyString(1)))
+	assert.Nil(t, nb.Query(util.GenerateKeyString(2)))
+
+	// 预分配的空间全部为0
+	nb, err = restore(append(append([]byte(nil), data...), make([]byte, 64)...))
+	assert.Nil(t, err)
+	assert.NotNil(t, nb.Query(util.GenerateKeyString(2)))
+
+	// 中间的记录损坏
+	bad = append([]byte(nil), data...)
+	bad[size+walHeaderSize] ^= 0xff
+	_, err = restore(bad)
+	assert.ErrorIs(t, err, ErrWalCorrupted)
+}
+
+func TestLsm_WalTornTail(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir)
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	for i := range 10 {
+		assert.Nil(t, db.Put(util.GenerateKeyString(i), util.GenerateValueString(12)))
+	}
+	db.waitForCompact()
+	db.walWriter.Close()
+	fileName := db.walFile(db.walNumber)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(fileName, info.Size()-5))
+
+	// 末尾写了一半的记录被截掉 之后追加的记录可以正常恢复
+	crash(db)
+	db = NewLsm(opts)
+	assert.Nil(t, db.Put(util.GenerateKeyString(100), util.GenerateValueString(12)))
+	db.walWriter.Close()
+	crash(db)
+
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	for i := range 9 {
+		_, err := db.Query(util.GenerateKeyString(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Query(util.GenerateKeyString(9))
+	assert.Equal(t, ErrorNotExist, err)
+	_, err = db.Query(util.GenerateKeyString(100))
+	assert.Nil(t, err)
+}
+
+func TestLsm_WalRecoveryMode(t *testing.T) {
+	// 000001.wal中有三个batch 第二个损坏 000002.wal中有一个batch
+	// 每个batch正好占满一个block 损坏的block之后可以继续读取
+	value := strings.Repeat("v", walBlockSize-walHeaderSize-43)
+	setup := func(mode WalRecoveryMode) (*Options, int64) {
+		dir := t.TempDir()
+		opts, err := NewOptions(dir, WithWalRecoveryMode(mode))
+		assert.Nil(t, err)
+		for number, keys := range map[int][]int{1: {0, 1, 2}, 2: {3}} {
+			w, err := NewWalWriter(path.Join(dir, WalFileName, fmt.Sprintf("%06d%s", number, WalSuffix)))
+			assert.Nil(t, err)
+			for _, i := range keys {
+				_, err := w.Write(&Record{Key: util.GenerateKeyString(i), Value: value, RType: RecordUpdate, Seq: uint64(i + 1)})
+				assert.Nil(t, err)
+			}
+			w.Close()
+		}
+		fileName := path.Join(dir, WalFileName, "000001.wal")
+		data, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		size := int64(len(data) / 3)
+		assert.Equal(t, int64(walBlockSize), size)
+		data[size+walHeaderSize] ^= 0xff
+		assert.Nil(t, os.WriteFile(fileName, data, os.ModePerm))
+		return opts, size
+	}
+	exists := func(db *Lsm, i int) bool {
+		_, err := db.Query(util.GenerateKeyString(i))
+		return err == nil
+	}
+
+	for _, mode := range []WalRecoveryMode{WalRecoveryTolerateCorruptedTail, WalRecoveryAbsoluteConsistency} {
+		opts, _ := setup(mode)
+		_, err := DefaultLsmTree(opts)
+		assert.ErrorIs(t, err, ErrWalCorrupted)
+	}
+
+	opts, size := setup(WalRecoveryPointInTime)
+	db, err := DefaultLsmTree(opts)
+	assert.Nil(t, err)
+	assert.True(t, exists(db, 0))
+	assert.False(t, exists(db, 1) || exists(db, 2) || exists(db, 3))
+	report := db.WalRecoveryReport()
+	assert.Equal(t, 2, len(report))
+	assert.Equal(t, 2, report[0].Records)
+	assert.Equal(t, 2*size, report[0].Bytes)
+	assert.Equal(t, 1, report[1].Records)
+	db.waitForCompact()
+
+	opts, size = setup(WalRecoverySkipAnyCorruptedRecords)
+	db, err = DefaultLsmTree(opts)
+	assert.Nil(t, err)
+	assert.True(t, exists(db, 0) && exists(db, 2) && exists(db, 3))
+	assert.False(t, exists(db, 1))
+	report = db.WalRecoveryReport()
+	assert.Equal(t, 1, len(report))
+	assert.Equal(t, 1, report[0].Records)
+	assert.Equal(t, size, report[0].Bytes)
+	db.waitForCompact()
+}
+
+func TestLsm_WalSkipCorruptedEmpty(t *testing.T) {
+	// 000001.wal中唯一的记录损坏 跳过之后没有数据 不能生成空的sst
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithWalRecoveryMode(WalRecoverySkipAnyCorruptedRecords))
+	assert.Nil(t, err)
+	for number := 1; number <= 2; number++ {
+		w, err := NewWalWriter(path.Join(dir, WalFileName, fmt.Sprintf("%06d%s", number, WalSuffix)))
+		assert.Nil(t, err)
+		_, err = w.Write(&Record{Key: util.GenerateKeyString(number), Value: "v", RType: RecordUpdate, Seq: uint64(number)})
+		assert.Nil(t, err)
+		w.Close()
+	}
+	fileName := path.Join(dir, WalFileName, "000001.wal")
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	data[walHeaderSize] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, data, os.ModePerm))
+
+	db, err := DefaultLsmTree(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	db.waitForCompact()
+	assert.Equal(t, 0, len(db.nodes[0]))
+	assert.Equal(t, 1, len(db.WalRecoveryReport()))
+	_, err = db.Query(util.GenerateKeyString(1))
+	assert.Equal(t, ErrorNotExist, err)
+	_, err = db.Query(util.GenerateKeyString(2))
+	assert.Nil(t, err)
+}
+
+func TestWal_AbsoluteConsistencyTornTail(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir, WithWalRecoveryMode(WalRecoveryAbsoluteConsistency))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	assert.Nil(t, db.Put(util.GenerateKeyString(0), util.GenerateValueString(12)))
+	db.walWriter.Close()
+	crash(db)
+	fileName := db.walFile(db.walNumber)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(fileName, info.Size()-1))
+	_, err = DefaultLsmTree(opts)
+	assert.ErrorIs(t, err, ErrWalCorrupted)
+}
+
+func TestWal_Fragment(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "1.wal")
+	walWriter, err := NewWalWriter(fileName)
+	assert.Nil(t, err)
+	// 大的batch切分为多个片段 跨越多个block
+	for i := range 10 {
+		batch := NewWriteBatch()
+		batch.Put(util.GenerateKeyString(i), strings.Repeat("v", 20000*(i%3+1)))
+		_, err = walWriter.WriteBatch(batch)
+		assert.Nil(t, err)
+	}
+	walWriter.Close()
+
+	walReader, err := NewWalReader(fileName)
+	assert.Nil(t, err)
+	var keys []string
+	for walReader.Next() {
+		for _, record := range walReader.Batch().records {
+			assert.Equal(t, 20000*(len(keys)%3+1), len(record.Value))
+			keys = append(keys, record.Key)
+		}
+	}
+	assert.Nil(t, walReader.Err())
+	assert.Equal(t, 10, len(keys))
+	walReader.Close()
+
+	// 第一个block损坏 跳过之后从下一个block继续读取
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	data[100] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, data, os.ModePerm))
+	walReader, err = NewWalReader(fileName)
+	assert.Nil(t, err)
+	defer walReader.Close()
+	nb := NewMemTable()
+	assert.ErrorIs(t, walReader.RestoreToMemTable(nb), ErrWalCorrupted)
+
+	walReader, err = NewWalReader(fileName)
+	assert.Nil(t, err)
+	defer walReader.Close()
+	assert.Nil(t, walReader.recover(nb, WalRecoverySkipAnyCorruptedRecords, false))
+	assert.Nil(t, nb.Query(util.GenerateKeyString(0)))
+	assert.Nil(t, nb.Query(util.GenerateKeyString(1)))
+	for i := 2; i < 10; i++ {
+		assert.NotNil(t, nb.Query(util.GenerateKeyString(i)))
+	}
+	// 第一个block 以及第二个batch在下一个block中的剩余片段
+	assert.Equal(t, 2, walReader.dropped.Records)
+	assert.Greater(t, walReader.dropped.Bytes, int64(walBlockSize))
+}
@@ -0,0 +1,169 @@
+package lsm
+
+import "sync"
+
+// WriteOptions 单次写入的选项
+type WriteOptions struct {
+	Sync       bool // 返回之前wal刷盘 断电也不会丢失
+	DisableWAL bool // 不写wal 数据落盘之前崩溃会丢失
+}
+
+var defaultWriteOptions = &WriteOptions{}
+
+// 一次合并写入的最大字节数 避免小的写入等待太久
+const maxWriteGroupBytes = 1 << 20
+
+// writer 等待写入的请求 batch为nil时不写入数据 只将缓冲区中的wal写入文件
+type writer struct {
+	batch     *WriteBatch
+	opts      *WriteOptions
+	exclusive func() error // 不为nil时单独执行 期间没有其他写入
+	done      bool
+	err       error
+	cond      *sync.Cond
+}
+
+func (t *Lsm) write(opts *WriteOptions, batch *WriteBatch) error {
+	if t.opts.readOnly {
+		return ErrReadOnly
+	}
+	return t.enqueue(&writer{batch: batch, opts: opts})
+}
+
+// 在写入队列中单独执行fn 用于切换memtable和关闭
+func (t *Lsm) runExclusive(fn func() error) error {
+	return t.enqueue(&writer{opts: defaultWriteOptions, exclusive: fn})
+}
+
+// 写入请求排队 队首的请求作为leader 将之后兼容的请求合并为一组
+// 整组只写一条wal记录 只刷盘一次 完成之后唤醒组内的其他请求
+func (t *Lsm) enqueue(w *writer) error {
+	w.cond = sync.NewCond(&t.writeMu)
+	t.writeMu.Lock()
+	t.writers = append(t.writers, w)
+	for !w.done && t.writers[0] != w {
+		w.cond.Wait()
+	}
+	if w.done {
+		t.writeMu.Unlock()
+		return w.err
+	}
+	group := t.buildWriteGroup()
+	t.writeMu.Unlock()
+
+	var err error
+	switch {
+	case t.closed.Load():
+		err = ErrClosed
+	case w.exclusive != nil:
+		err = w.exclusive()
+	default:
+		err = t.writeGroup(group)
+	}
+
+	t.writeMu.Lock()
+	t.writers = t.writers[len(group):]
+	for _, g := range group[1:] {
+		g.err, g.done = err, true
+		g.cond.Signal()
+	}
+	if len(t.writers) > 0 {
+		t.writers[0].cond.Signal()
+	}
+	t.writeMu.Unlock()
+	return err
+}
+
+// 从队首开始选择可以合并的请求 需要持有t.writeMu
+// leader不刷盘时不合并需要刷盘的请求 不写wal的请求只和同类合并 单独执行的请求不合并
+func (t *Lsm) buildWriteGroup() []*writer {
+	leader := t.writers[0]
+	group := []*writer{leader}
+	if leader.exclusive != nil {
+		return group
+	}
+	size := batchSize(leader.batch)
+	for _, w := range t.writers[1:] {
+		if w.exclusive != nil || w.opts.Sync && !leader.opts.Sync || w.opts.DisableWAL != leader.opts.DisableWAL {
+			break
+		}
+		size += batchSize(w.batch)
+		if size > maxWriteGroupBytes {
+			break
+		}
+		group = append(group, w)
+	}
+	return group
+}
+
+func batchSize(batch *WriteBatch) int {
+	size := 0
+	if batch != nil {
+		for _, record := range batch.records {
+			size += len(record.Key) + len(record.Value)
+		}
+	}
+	return size
+}
+
+// 写入一组请求 由leader执行 同一时刻只有一个leader
+// 写wal时不持有t.lock 读请求不会被刷盘阻塞
+func (t *Lsm) writeGroup(group []*writer) error {
+	leader := group[0]
+	// 拷贝一份 batch可能被调用方重复使用
+	var records []*Record
+	for _, w := range group {
+		if w.batch == nil {
+			continue
+		}
+		for _, record := range w.batch.records {
+			records = append(records, &Record{Key: record.Key, Value: record.Value, RType: record.RType, Seq: t.seq + uint64(len(records)) + 1})
+		}
+	}
+	if !leader.opts.DisableWAL {
+		// 默认每次写入之后都写入文件 manualWalFlush时由FlushWAL或者缓冲区满时写入
+		flush := !t.opts.manualWalFlush
+		for _, w := range group {
+			flush = flush || w.batch == nil
+		}
+		if len(records) > 0 {
+			if _, err := t.walWriter.addBatch(&WriteBatch{records: records}); err != nil {
+				return err
+			}
+		}
+		if leader.opts.Sync {
+			if err := t.walWriter.Sync(); err != nil {
+				return err
+			}
+		} else if flush {
+			if err := t.walWriter.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.seq += uint64(len(records))
+	for _, record := range records {
+		t.memTable.Set(record)
+	}
+	if t.checkOverflow() {
+		return t.refreshMemTableLocked()
+	}
+	return nil
+}
+
+// SyncWAL 将之前写入的wal刷盘
+func (t *Lsm) SyncWAL() error {
+	return t.write(&WriteOptions{Sync: true}, nil)
+}
+
+// FlushWAL 将缓冲区中的wal写入文件 进程崩溃不会丢失 断电仍然可能丢失
+// 只有设置WithManualWalFlush时wal才会停留在缓冲区中
+func (t *Lsm) FlushWAL() error {
+	return t.write(defaultWriteOptions, nil)
+}
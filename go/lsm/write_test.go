@@ -0,0 +1,166 @@
+package lsm
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xia-Sang/lsm_go/util"
+)
+
+func TestLsm_GroupCommit(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				key := util.GenerateKeyString(g*100 + i)
+				assert.Nil(t, db.PutWithOptions(&WriteOptions{Sync: i%2 == 0}, key, key))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(400), db.seq)
+	db.walWriter.Close()
+	crash(db)
+
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	for g := range 8 {
+		for i := range 50 {
+			key := util.GenerateKeyString(g*100 + i)
+			value, err := db.Query(key)
+			assert.Nil(t, err)
+			assert.Equal(t, key, value)
+		}
+	}
+}
+
+func TestLsm_WriteGroup(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	defer db.Close()
+
+	// 单独执行的请求占住队首 之后的写入在队列中等待
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = db.runExclusive(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := util.GenerateKeyString(i)
+			assert.Nil(t, db.Put(key, key))
+		}()
+	}
+	for queued := 0; queued < 9; time.Sleep(time.Millisecond) {
+		db.writeMu.Lock()
+		queued = len(db.writers)
+		db.writeMu.Unlock()
+	}
+	close(release)
+	wg.Wait()
+
+	// 等待的写入由一个leader合并写入 wal中只有一条记录 序列号连续
+	walReader, err := NewWalReader(db.walFile(db.walNumber))
+	assert.Nil(t, err)
+	defer walReader.Close()
+	var batches []*WriteBatch
+	for walReader.Next() {
+		batches = append(batches, walReader.Batch())
+	}
+	assert.Nil(t, walReader.Err())
+	assert.Equal(t, 1, len(batches))
+	assert.Equal(t, 8, batches[0].Count())
+	for i, record := range batches[0].records {
+		assert.Equal(t, uint64(i+1), record.Seq)
+	}
+	assert.Equal(t, uint64(8), db.seq)
+}
+
+func TestLsm_DisableWAL(t *testing.T) {
+	opts, err := NewOptions(t.TempDir())
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	assert.Nil(t, db.Put("a", "1"))
+	assert.Nil(t, db.PutWithOptions(&WriteOptions{DisableWAL: true}, "b", "2"))
+	_, err = db.Query("b")
+	assert.Nil(t, err)
+	db.walWriter.Close()
+	crash(db)
+
+	// 没有写wal的数据在重启之后丢失
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	_, err = db.Query("a")
+	assert.Nil(t, err)
+	_, err = db.Query("b")
+	assert.Equal(t, ErrorNotExist, err)
+}
+
+func TestLsm_ManualWalFlush(t *testing.T) {
+	opts, err := NewOptions(t.TempDir(), WithManualWalFlush(true))
+	assert.Nil(t, err)
+	db := NewLsm(opts)
+	assert.Nil(t, db.Put("a", "1"))
+	assert.Nil(t, db.FlushWAL())
+	assert.Nil(t, db.Put("b", "2"))
+	assert.Nil(t, db.SyncWAL())
+	assert.Nil(t, db.Put("c", "3"))
+	// 模拟进程崩溃 缓冲区中的wal没有写入文件
+	_ = db.walWriter.dest.Close()
+	crash(db)
+
+	db = NewLsm(opts)
+	defer db.waitForCompact()
+	for _, key := range []string{"a", "b"} {
+		_, err = db.Query(key)
+		assert.Nil(t, err)
+	}
+	_, err = db.Query("c")
+	assert.Equal(t, ErrorNotExist, err)
+}
+
+func TestLsm_DisableWALEmptyWal(t *testing.T) {
+	dir := t.TempDir()
+	opts, err := NewOptions(dir)
+	assert.Nil(t, err)
+	// 只有DisableWAL写入的memtable切换之后留下空的wal
+	for _, name := range []string{"000001.wal", "000002.wal"} {
+		assert.Nil(t, os.WriteFile(path.Join(dir, WalFileName, name), nil, os.ModePerm))
+	}
+	db, err := DefaultLsmTree(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	db.waitForCompact()
+	assert.Equal(t, 0, len(db.nodes[0]))
+	_, err = os.Stat(path.Join(dir, WalFileName, "000001.wal"))
+	assert.True(t, os.IsNotExist(err))
+
+	// 没有block的sst不能打开
+	fileName := path.Join(dir, "empty.sst")
+	w, err := NewSSTWriter(fileName, opts)
+	assert.Nil(t, err)
+	_, err = w.SyncMemTable(NewMemTable())
+	assert.Nil(t, err)
+	w.Close()
+	r, err := NewSSTReader(fileName)
+	assert.Nil(t, err)
+	_, err = NewNode(fileName, r, opts, nil)
+	assert.NotNil(t, err)
+}